@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/chestnutsj/hls/pkg/display"
@@ -10,16 +11,20 @@ import (
 	"github.com/chestnutsj/hls/pkg/hook"
 	"github.com/chestnutsj/hls/pkg/log"
 	"github.com/chestnutsj/hls/pkg/m3u"
+	"github.com/chestnutsj/hls/pkg/metalink"
 	"github.com/chestnutsj/hls/pkg/metrics"
 	"github.com/chestnutsj/hls/pkg/task"
 	"github.com/jinzhu/configor"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 var (
@@ -27,6 +32,18 @@ var (
 	Version   = "unknown"
 )
 
+// exit codes of a failed run, CI tells a missing file from a full disk by them
+const (
+	exitFailure    = 1
+	exitValidation = 2
+	exitStatus     = 3
+	exitNotFound   = 4
+	exitNetwork    = 5
+	exitDisk       = 6
+	exitChecksum   = 7
+	exitCancelled  = 130
+)
+
 var Cfg = struct {
 	Download task.Config `yaml:"download"`
 	Log      log.Config  `yaml:"log"`
@@ -37,13 +54,21 @@ var Cfg = struct {
 func main() {
 
 	configFile := flag.String("config", "", "configuration file")
-	urlStr := flag.String("u", "", "download url")
-	output := flag.String("o", "", "output dir")
+	var urls urlList
+	flag.Var(&urls, "u", "download url, repeat it to add mirrors of the same file")
+	mirrorFile := flag.String("mirrors", "", "file with one mirror url per line")
+	output := flag.String("o", "", "output file, or an existing dir or one ending in / where the response names the file; the dir of -m and -metalink")
 	m3uUrl := flag.String("m", "", "it is a m3u8 file")
+	metalinkFile := flag.String("metalink", "", "a .meta4 or .metalink file describing the download")
+	location := flag.String("location", "", "preferred mirror locations of a metalink, e.g. de,fr")
 	version := flag.Bool("v", false, "Show version")
 	help := flag.Bool("h", false, "Show help")
 	loadPlugin := flag.String("plugin", hook.PluginName, "download decode plugin")
 	genCfg := flag.Bool("genCfg", false, "generator config ")
+	cookieFile := flag.String("cookies", "", "Netscape cookies.txt sent with every request")
+	netrc := flag.Bool("netrc", false, "look credentials up in ~/.netrc")
+	proxy := flag.String("proxy", "", "proxy url, http://, socks5:// or direct")
+	naming := flag.String("naming", "", "how to name a download without -o: auto, header, final or url")
 
 	flag.Parse()
 
@@ -81,33 +106,91 @@ func main() {
 	} else {
 		err = configor.Load(&Cfg, *configFile)
 	}
+	if len(*mirrorFile) > 0 {
+		mirrors, mErr := readMirrors(*mirrorFile)
+		if mErr != nil {
+			fmt.Println("read mirrors failed:", mErr)
+			os.Exit(exitValidation)
+		}
+		urls = append(urls, mirrors...)
+	}
+	if len(*cookieFile) > 0 {
+		Cfg.Download.Auth.CookieFile = *cookieFile
+	}
+	if *netrc {
+		Cfg.Download.Auth.Netrc = true
+	}
+	if len(*proxy) > 0 {
+		Cfg.Download.Proxy.URL = *proxy
+	}
+	if len(*naming) > 0 {
+		Cfg.Download.Naming = *naming
+	}
+	urlStr := urls.First()
 	fmt.Println("config:", Cfg)
 
 	if len(*m3uUrl) > 0 {
 		fmt.Println("url", *m3uUrl)
 	} else {
-		fmt.Println("url", *urlStr)
+		fmt.Println("url", urls.String())
 	}
 	fmt.Println("output", *output)
 
 	log.InitLogger(Cfg.Log)
 	if err != nil {
 		zap.L().Error("load config error", zap.Error(err))
-		os.Exit(1)
+		os.Exit(exitValidation)
+	}
+
+	if err = download.SetupRateLimit(&Cfg.Download); err != nil {
+		zap.L().Error("rate limit config error", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	if err = download.ValidateProxy(Cfg.Download.Proxy); err != nil {
+		zap.L().Error("proxy config error", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	if err = download.ValidateTLS(Cfg.Download.TLS); err != nil {
+		zap.L().Error("tls config error", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	if err = download.ValidateNetwork(Cfg.Download.Network); err != nil {
+		zap.L().Error("network config error", zap.Error(err))
+		os.Exit(exitCode(err))
+	}
+	if err = download.ValidateRequest(Cfg.Download.Request); err != nil {
+		zap.L().Error("request config error", zap.Error(err))
+		os.Exit(exitCode(err))
 	}
 
 	if Cfg.Metric != "" {
 		go metrics.StartMetrics(Cfg.Metric, Cfg.Debug)
 	}
 
-	ctx := context.Background()
+	ctx, stop := signalContext()
+	defer stop()
 	p := display.NewDisplay()
+	if len(*metalinkFile) == 0 && metalink.IsMetalink(urlStr) {
+		if _, err := os.Stat(urlStr); err == nil {
+			*metalinkFile = urlStr
+		}
+	}
+	if len(*metalinkFile) > 0 {
+		err = runMetalink(ctx, p, *metalinkFile, *output, *location)
+		if err != nil {
+			log.Error("download", zap.Error(err))
+			printResume()
+			os.Exit(exitCode(err))
+		}
+		fmt.Println("download success ", *metalinkFile)
+		return
+	}
 	var job task.Task
 	if len(*m3uUrl) > 0 {
 		u, err := url.Parse(*m3uUrl)
 		if err != nil {
 			zap.L().Error("parse url error", zap.Error(err))
-			return
+			os.Exit(exitValidation)
 		}
 		dir := *output
 		if len(dir) <= 2 {
@@ -120,29 +203,39 @@ func main() {
 		job = m3u.NewM3uTask(ctx, p, &Cfg.Download, u, dir)
 	} else {
 
-		if len(*urlStr) == 0 {
+		if len(urlStr) == 0 {
 			log.Error("url is empty")
-			return
+			os.Exit(exitValidation)
 		}
-		u, err := url.Parse(*urlStr)
+		u, err := url.Parse(urlStr)
 		if err != nil {
 			zap.L().Error("parse url error", zap.Error(err))
-			return
+			os.Exit(exitValidation)
+		}
+		mirrors := make([]*url.URL, 0, len(urls))
+		for _, m := range urls[1:] {
+			mu, err := url.Parse(m)
+			if err != nil {
+				zap.L().Error("parse mirror url error", zap.String("url", m), zap.Error(err))
+				continue
+			}
+			mirrors = append(mirrors, mu)
 		}
 
+		// without a file name the response names it
 		filename := *output
-		if len(*output) == 0 {
-			filename = filepath.Base(u.Path)
-		}
-		job = download.NewHttpTask(ctx, u, filename, false, &Cfg.Download, p)
+		job = download.NewHttpTask(ctx, u, filename, false, &Cfg.Download, p, mirrors...)
 	}
 
 	err = job.Start()
+	printSummary(job)
 	if err != nil {
 		log.Error("download", zap.Error(err))
+		printResume()
+		os.Exit(exitCode(err))
 	} else {
 		log.Info("download success")
-		fmt.Println("download success ", *urlStr)
+		fmt.Println("download success ", urlStr)
 
 		if len(*m3uUrl) > 0 && len(*loadPlugin) > 0 {
 			data, err := job.Extra()
@@ -167,6 +260,155 @@ func main() {
 
 }
 
+// runMetalink downloads every file of a metalink into dir one after another.
+func runMetalink(ctx context.Context, p *display.Display, name string, dir string, location string) error {
+	ml, err := metalink.ParseFile(name)
+	if err != nil {
+		return err
+	}
+	var locations []string
+	if len(location) > 0 {
+		locations = strings.Split(location, ",")
+	}
+	for i := range ml.Files {
+		file := &ml.Files[i]
+		file.SortURLs(locations...)
+		job, err := download.NewMetalinkTask(ctx, file, dir, false, &Cfg.Download, p)
+		if err != nil {
+			return err
+		}
+		err = job.Start()
+		printSummary(job)
+		if err != nil {
+			fmt.Printf("%d of %d files completed\n", i, len(ml.Files))
+			return err
+		}
+	}
+	return nil
+}
+
+// signalContext is cancelled by the first SIGINT or SIGTERM so the running chunks
+// write what they received and the progress is saved, the second one exits at once.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			fmt.Fprintf(os.Stderr, "\n%s: saving the progress, repeat to quit now\n", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		<-sigs
+		fmt.Fprintln(os.Stderr, "quit without saving the progress")
+		os.Exit(exitCancelled)
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+// printSummary tells what a task downloaded and what is left.
+func printSummary(t task.Task) {
+	switch r := t.(type) {
+	case *m3u.Task:
+		done, failed, total := r.Segments()
+		if total > 0 {
+			fmt.Printf("%d of %d segments completed, %d failed, %d remaining\n",
+				done, total, failed, total-done-failed)
+		}
+	case task.Reporter:
+		done, total := r.Transferred()
+		if total > 0 {
+			fmt.Printf("%d of %d bytes downloaded, %d remaining\n", done, total, total-done)
+		} else {
+			fmt.Printf("%d bytes downloaded\n", done)
+		}
+	}
+}
+
+// printResume tells how to continue the download, the same command line picks up the
+// status files left next to the output.
+func printResume() {
+	args := make([]string, len(os.Args))
+	for i, a := range os.Args {
+		args[i] = a
+		if a == "" || strings.ContainsAny(a, " \t\"'$&|;<>*?") {
+			args[i] = strconv.Quote(a)
+		}
+	}
+	fmt.Println("run it again to resume:", strings.Join(args, " "))
+}
+
+// exitCode maps the typed errors of the download to the exit codes.
+func exitCode(err error) int {
+	var (
+		invalid  *task.ValidationError
+		status   *download.StatusError
+		network  *download.NetworkError
+		disk     *download.DiskError
+		checksum *download.ChecksumError
+	)
+	switch {
+	case err == nil:
+		return 0
+	case task.IsCancelled(err):
+		return exitCancelled
+	case errors.As(err, &invalid):
+		return exitValidation
+	case errors.As(err, &status):
+		if status.Code == http.StatusNotFound || status.Code == http.StatusGone {
+			return exitNotFound
+		}
+		return exitStatus
+	case errors.As(err, &network):
+		return exitNetwork
+	case errors.As(err, &disk):
+		return exitDisk
+	case errors.As(err, &checksum):
+		return exitChecksum
+	}
+	return exitFailure
+}
+
+type urlList []string
+
+func (l *urlList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *urlList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (l *urlList) First() string {
+	if len(*l) == 0 {
+		return ""
+	}
+	return (*l)[0]
+}
+
+// readMirrors reads one url per line, empty lines and lines starting with # are skipped.
+func readMirrors(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var mirrors []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mirrors = append(mirrors, line)
+	}
+	return mirrors, nil
+}
+
 func addExeSuffix(n string) string {
 
 	if len(filepath.Ext(n)) == 0 {
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/chestnutsj/hls/pkg/download"
+	"github.com/chestnutsj/hls/pkg/task"
+	"testing"
+)
+
+// the codes are the contract for scripts, they are spelled out here
+func Test_exitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"cancelled", &task.CancelledError{Err: context.Canceled}, 130},
+		{"validation", task.Invalid("url", errors.New("empty")), 2},
+		{"not found", &download.StatusError{Code: 404}, 4},
+		{"gone", &download.StatusError{Code: 410}, 4},
+		{"status", &download.StatusError{Code: 503}, 3},
+		{"network", &download.NetworkError{Err: errors.New("reset")}, 5},
+		{"disk", &download.DiskError{Op: "write", Err: errors.New("full")}, 6},
+		{"checksum", &download.ChecksumError{Hash: "sha-256"}, 7},
+		{"wrapped", fmt.Errorf("segment: %w", &download.DiskError{Op: "write"}), 6},
+		{"other", errors.New("boom"), 1},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
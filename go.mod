@@ -1,16 +1,21 @@
 module github.com/chestnutsj/hls
 
-go 1.21
+go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/hashicorp/go-hclog v0.14.1
 	github.com/hashicorp/go-plugin v1.6.1
 	github.com/jinzhu/configor v1.2.2
+	github.com/jlaffaye/ftp v0.2.0
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-isatty v0.0.20
 	github.com/natefinch/lumberjack v2.0.0+incompatible
+	github.com/pkg/sftp v1.13.6
 	github.com/prometheus/client_golang v1.11.0
 	github.com/vbauerster/mpb/v8 v8.7.4
 	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.23.0
 	gopkg.in/yaml.v2 v2.3.0
 )
 
@@ -23,7 +28,10 @@ require (
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/hashicorp/yamux v0.1.1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mattn/go-runewidth v0.0.15 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
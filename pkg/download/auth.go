@@ -0,0 +1,341 @@
+package download
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/chestnutsj/hls/pkg/log"
+	"github.com/chestnutsj/hls/pkg/task"
+	"go.uber.org/zap"
+)
+
+const (
+	AuthBasic  = "basic"
+	AuthDigest = "digest"
+)
+
+// credentials are sent only to the hosts they were configured for. The transport adds
+// them on every hop, so a redirect to another host never sees them.
+type authTransport struct {
+	base     http.RoundTripper
+	kind     string
+	user     string
+	password string
+	token    string
+	hosts    map[string]bool
+	netrc    map[string]netrcEntry
+
+	mu     sync.Mutex
+	digest *digestChallenge
+}
+
+// newAuthTransport resolves the credentials of cfg for origins, nil when there are none.
+func newAuthTransport(base http.RoundTripper, cfg task.AuthConfig, origins ...string) *authTransport {
+	a := &authTransport{
+		base:     base,
+		kind:     strings.ToLower(cfg.Type),
+		user:     cfg.User,
+		password: cfg.Password,
+		token:    resolveToken(cfg),
+		hosts:    make(map[string]bool),
+	}
+	if a.kind == "" {
+		a.kind = AuthBasic
+	}
+	for _, h := range cfg.Hosts {
+		a.hosts[strings.ToLower(h)] = true
+	}
+	if len(a.hosts) == 0 {
+		for _, origin := range origins {
+			if u, err := url.Parse(origin); err == nil && u.Host != "" {
+				a.hosts[strings.ToLower(u.Hostname())] = true
+			}
+		}
+	}
+	if cfg.Netrc {
+		name := cfg.NetrcFile
+		if name == "" {
+			name = defaultNetrc()
+		}
+		entries, err := parseNetrc(name)
+		if err != nil {
+			log.Warn("read netrc failed", zap.String("file", name), zap.Error(err))
+		}
+		a.netrc = entries
+	}
+	if a.user == "" && a.token == "" && len(a.netrc) == 0 {
+		return nil
+	}
+	return a
+}
+
+func resolveToken(cfg task.AuthConfig) string {
+	if cfg.Token != "" {
+		return cfg.Token
+	}
+	if cfg.TokenEnv != "" {
+		if v := os.Getenv(cfg.TokenEnv); v != "" {
+			return v
+		}
+	}
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			log.Warn("read token file failed", zap.String("file", cfg.TokenFile), zap.Error(err))
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+// credentialsFor returns the user and password for host, configured ones win over netrc.
+func (a *authTransport) credentialsFor(host string) (string, string, bool) {
+	host = strings.ToLower(host)
+	if a.user != "" && a.hosts[host] {
+		return a.user, a.password, true
+	}
+	if e, ok := a.netrc[host]; ok {
+		return e.login, e.password, true
+	}
+	if e, ok := a.netrc[""]; ok && len(a.hosts) > 0 && a.hosts[host] {
+		return e.login, e.password, true
+	}
+	return "", "", false
+}
+
+func (a *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	user, password, hasUser := a.credentialsFor(host)
+	allowed := a.hosts[strings.ToLower(host)]
+	if req.Header.Get("Authorization") != "" || (!hasUser && !(allowed && a.token != "")) {
+		return a.base.RoundTrip(req)
+	}
+
+	r := req.Clone(req.Context())
+	switch {
+	case allowed && a.token != "":
+		r.Header.Set("Authorization", "Bearer "+a.token)
+	case a.kind == AuthDigest:
+		if c := a.challenge(); c != nil {
+			r.Header.Set("Authorization", c.authorize(user, password, r.Method, r.URL.RequestURI()))
+		}
+	default:
+		r.SetBasicAuth(user, password)
+	}
+	resp, err := a.base.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || a.kind != AuthDigest || !hasUser {
+		return resp, err
+	}
+
+	// answer the digest challenge once
+	c, err := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	_ = resp.Body.Close()
+	a.mu.Lock()
+	a.digest = c
+	a.mu.Unlock()
+	retry.Header.Set("Authorization", c.authorize(user, password, retry.Method, retry.URL.RequestURI()))
+	return a.base.RoundTrip(retry)
+}
+
+func (a *authTransport) challenge() *digestChallenge {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.digest
+}
+
+type digestChallenge struct {
+	mu        sync.Mutex
+	realm     string
+	nonce     string
+	opaque    string
+	qop       string
+	algorithm string
+	nc        int
+}
+
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+		return nil, fmt.Errorf("not a digest challenge: %q", header)
+	}
+	c := &digestChallenge{algorithm: "MD5"}
+	for _, part := range splitParams(header[len("digest "):]) {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "realm":
+			c.realm = v
+		case "nonce":
+			c.nonce = v
+		case "opaque":
+			c.opaque = v
+		case "algorithm":
+			c.algorithm = v
+		case "qop":
+			// prefer auth over auth-int, the body is not hashed
+			for _, q := range strings.Split(v, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					c.qop = "auth"
+				}
+			}
+		}
+	}
+	if c.nonce == "" {
+		return nil, fmt.Errorf("digest challenge without nonce: %q", header)
+	}
+	return c, nil
+}
+
+// splitParams splits on commas that are not inside quotes.
+func splitParams(s string) []string {
+	var parts []string
+	quoted := false
+	last := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(parts, s[last:])
+}
+
+func (c *digestChallenge) authorize(user, password, method, uri string) string {
+	c.mu.Lock()
+	c.nc++
+	nc := fmt.Sprintf("%08x", c.nc)
+	c.mu.Unlock()
+
+	var newHash func() hash.Hash = md5.New
+	algorithm := strings.ToUpper(c.algorithm)
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	h := func(s string) string {
+		x := newHash()
+		x.Write([]byte(s))
+		return hex.EncodeToString(x.Sum(nil))
+	}
+	cnonce := make([]byte, 8)
+	_, _ = rand.Read(cnonce)
+	cn := hex.EncodeToString(cnonce)
+
+	ha1 := h(user + ":" + c.realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cn)
+	}
+	ha2 := h(method + ":" + uri)
+	var response string
+	if c.qop != "" {
+		response = h(strings.Join([]string{ha1, c.nonce, nc, cn, c.qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	v := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, response="%s"`,
+		user, c.realm, c.nonce, uri, c.algorithm, response)
+	if c.qop != "" {
+		v += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, c.qop, nc, cn)
+	}
+	if c.opaque != "" {
+		v += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	return v
+}
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+func defaultNetrc() string {
+	if v := os.Getenv("NETRC"); v != "" {
+		return v
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// parseNetrc reads machine, login and password tokens, "default" is stored under "".
+func parseNetrc(name string) (map[string]netrcEntry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]netrcEntry)
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanWords)
+	machine := ""
+	inMachine := false
+	var e netrcEntry
+	flush := func() {
+		if inMachine {
+			entries[machine] = e
+		}
+		e = netrcEntry{}
+	}
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine":
+			flush()
+			if scanner.Scan() {
+				machine = strings.ToLower(scanner.Text())
+				inMachine = true
+			}
+		case "default":
+			flush()
+			machine = ""
+			inMachine = true
+		case "login":
+			if scanner.Scan() {
+				e.login = scanner.Text()
+			}
+		case "password":
+			if scanner.Scan() {
+				e.password = scanner.Text()
+			}
+		case "macdef":
+			// a macro runs until an empty line, nothing we need
+			flush()
+			inMachine = false
+		}
+	}
+	flush()
+	return entries, scanner.Err()
+}
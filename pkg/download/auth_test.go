@@ -0,0 +1,145 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func authClient(t *testing.T, cfg task.AuthConfig, origin string) MyClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewClient(ctx, 0, time.Second, time.Second, WithAuth(cfg, origin))
+}
+
+func get(t *testing.T, client MyClient, url string) *http.Response {
+	req, err := client.NewRequest(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func Test_authBasicAndBearer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if (ok && user == "u" && pass == "p") || r.Header.Get("Authorization") == "Bearer tok" {
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	if resp := get(t, authClient(t, task.AuthConfig{User: "u", Password: "p"}, server.URL), server.URL); resp.StatusCode != http.StatusOK {
+		t.Fatal("basic", resp.Status)
+	}
+
+	t.Setenv("HLS_TEST_TOKEN", "tok")
+	if resp := get(t, authClient(t, task.AuthConfig{TokenEnv: "HLS_TEST_TOKEN"}, server.URL), server.URL); resp.StatusCode != http.StatusOK {
+		t.Fatal("bearer env", resp.Status)
+	}
+
+	name := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(name, []byte("tok\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get(t, authClient(t, task.AuthConfig{TokenFile: name}, server.URL), server.URL); resp.StatusCode != http.StatusOK {
+		t.Fatal("bearer file", resp.Status)
+	}
+}
+
+func Test_authDigest(t *testing.T) {
+	md5hex := func(s string) string {
+		h := md5.Sum([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	const realm, nonce = "hls", "abc123"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get("Authorization")
+		if !strings.HasPrefix(v, "Digest ") {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth,auth-int", opaque="xyz"`, realm, nonce))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		params := make(map[string]string)
+		for _, p := range splitParams(v[len("Digest "):]) {
+			k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+			params[k] = strings.Trim(val, `"`)
+		}
+		ha1 := md5hex("u:" + realm + ":p")
+		ha2 := md5hex(r.Method + ":" + params["uri"])
+		want := md5hex(strings.Join([]string{ha1, nonce, params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+		if params["response"] != want || params["opaque"] != "xyz" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	client := authClient(t, task.AuthConfig{Type: AuthDigest, User: "u", Password: "p"}, server.URL)
+	for i := 0; i < 2; i++ {
+		if resp := get(t, client, server.URL+"/seg.ts"); resp.StatusCode != http.StatusOK {
+			t.Fatal("digest", i, resp.Status)
+		}
+	}
+}
+
+func Test_authNetrc(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "nu" || pass != "np" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	name := filepath.Join(t.TempDir(), "netrc")
+	content := "machine other.example login x password y\nmachine 127.0.0.1\n  login nu\n  password np\n"
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := authClient(t, task.AuthConfig{Netrc: true, NetrcFile: name}, "http://unrelated.example/")
+	if resp := get(t, client, server.URL); resp.StatusCode != http.StatusOK {
+		t.Fatal("netrc", resp.Status)
+	}
+}
+
+func Test_authRedirectNoLeak(t *testing.T) {
+	var leaked string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+	// same server under another host name
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, otherURL+"/file", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	resp := get(t, authClient(t, task.AuthConfig{User: "u", Password: "p"}, origin.URL), origin.URL)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	if leaked != "" {
+		t.Fatal("credentials sent to the redirect target:", leaked)
+	}
+}
@@ -0,0 +1,94 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const benchSize = 8 * 1024 * 1024
+
+func benchServer(b *testing.B) (*httptest.Server, []byte) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), benchSize/16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	b.Cleanup(ts.Close)
+	return ts, data
+}
+
+// benchDownload runs a whole transfer into a file, threads 1 is the single stream path.
+func benchDownload(b *testing.B, threads int) {
+	ts, data := benchServer(b)
+	ctx := context.Background()
+	client := NewClient(ctx, 0, time.Second*3, time.Second*30)
+	dir := b.TempDir()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chunk, err := NewChunk(filepath.Join(dir, "bench.bin"), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		chunk.SetSyncPolicy(SyncNone, 0)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chunk.Run()
+		}()
+		tr := NewTransfer(ctx, nil, client, ts.URL, nil, 1024*1024*10)
+		if threads > 1 {
+			ranges := make(map[int64]int64)
+			for start := int64(0); start < int64(len(data)); start += 1024 * 1024 {
+				ranges[start] = min(start+1024*1024, int64(len(data)))
+			}
+			err = tr.DownloadMtiThread(chunk.writeChan, threads, ranges)
+		} else {
+			err = tr.DownloadPerThread(chunk.writeChan, 0, 0)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		chunk.Exit()
+		wg.Wait()
+		_ = chunk.Close()
+	}
+}
+
+func BenchmarkDownloadSingle(b *testing.B) {
+	benchDownload(b, 1)
+}
+
+func BenchmarkDownloadMulti(b *testing.B) {
+	benchDownload(b, 10)
+}
+
+// BenchmarkFileDataCopy is the old path: a fresh slice per read.
+func BenchmarkFileDataCopy(b *testing.B) {
+	data := make([]byte, readBufferSize)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		val := make([]byte, len(data))
+		copy(val, data)
+		_ = &fileData{pos: 0, data: val, start: 0}
+	}
+}
+
+// BenchmarkFileDataPooled reads into a pooled buffer that the writer hands back.
+func BenchmarkFileDataPooled(b *testing.B) {
+	b.SetBytes(readBufferSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f := newPooledFileData(0, getBuffer(), readBufferSize, 0)
+		f.Release()
+	}
+}
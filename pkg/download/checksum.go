@@ -0,0 +1,117 @@
+package download
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/chestnutsj/hls/pkg/log"
+	"github.com/chestnutsj/hls/pkg/metalink"
+	"go.uber.org/zap"
+)
+
+// Checksum is what a job verifies once every byte is on disk, hash names follow metalink 4.
+type Checksum struct {
+	Size        int64             `json:",omitempty"`
+	Hashes      map[string]string `json:",omitempty"`
+	PieceType   string            `json:",omitempty"`
+	PieceLength int64             `json:",omitempty"`
+	Pieces      []string          `json:",omitempty"`
+}
+
+// hashPreference lists the supported hashes, strongest first.
+var hashPreference = []string{"sha-512", "sha-384", "sha-256", "sha-1", "md5"}
+
+func newHash(name string) (hash.Hash, error) {
+	switch metalink.NormalizeHash(name) {
+	case "md5":
+		return md5.New(), nil
+	case "sha-1":
+		return sha1.New(), nil
+	case "sha-256":
+		return sha256.New(), nil
+	case "sha-384":
+		return sha512.New384(), nil
+	case "sha-512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash %s", name)
+}
+
+// BadPieces hashes every piece of path and returns the ranges [start, end) that do not match.
+// An unknown size is taken from the checksum, without one the pieces are not checked.
+func (c *Checksum) BadPieces(path string, size int64) (map[int64]int64, error) {
+	bad := make(map[int64]int64)
+	if c == nil || c.PieceLength <= 0 || len(c.Pieces) == 0 {
+		return bad, nil
+	}
+	if size <= 0 {
+		size = c.Size
+	}
+	if size <= 0 {
+		log.Warn("size unknown, pieces not verified", zap.String("file", path), zap.Int("pieces", len(c.Pieces)))
+		return bad, nil
+	}
+	h, err := newHash(c.PieceType)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for i, want := range c.Pieces {
+		start := int64(i) * c.PieceLength
+		end := start + c.PieceLength
+		if end > size {
+			end = size
+		}
+		if start >= end {
+			break
+		}
+		h.Reset()
+		if _, err = io.Copy(h, io.NewSectionReader(file, start, end-start)); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != want {
+			bad[start] = end
+		}
+	}
+	return bad, nil
+}
+
+// Verify checks the whole file against the strongest hash that is known.
+func (c *Checksum) Verify(path string) error {
+	if c == nil {
+		return nil
+	}
+	for _, name := range hashPreference {
+		want, ok := c.Hashes[name]
+		if !ok {
+			continue
+		}
+		h, _ := newHash(name)
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(h, file)
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != want {
+			return &ChecksumError{Path: path, Hash: name, Got: got, Want: want}
+		}
+		return nil
+	}
+	return nil
+}
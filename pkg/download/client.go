@@ -2,10 +2,12 @@ package download
 
 import (
 	"context"
-	"net"
+	"fmt"
+	"io"
 	"net/http"
 	"time"
 
+	"github.com/chestnutsj/hls/pkg/task"
 	"github.com/chestnutsj/hls/pkg/tools"
 	"go.uber.org/zap"
 )
@@ -21,37 +23,158 @@ type myClient struct {
 	maxRetries int
 	ctx        context.Context
 	cancel     context.CancelFunc
+	// request shapes every request, a config that does not parse fails them
+	request    *requestTemplate
+	requestErr error
+	vars       func(*RequestVars)
+	// signers run before every attempt
+	signers []Signer
 }
 
-func NewClient(ctx context.Context, maxRetry int, connTimeOut time.Duration, idleTimeOut time.Duration) MyClient {
+// clientSetup is what a ClientOption can change before the client is built.
+type clientSetup struct {
+	// transport selects the shared transport of the client
+	transport transportConfig
+	jar       http.CookieJar
+	// wrap is applied in order around the transport
+	wrap    []func(http.RoundTripper) http.RoundTripper
+	request task.RequestConfig
+	vars    func(*RequestVars)
+	// serverNameHosts limits transport.TLS.ServerName to these hosts
+	serverNameHosts map[string]bool
+	signer          Signer
+}
+
+type ClientOption func(*clientSetup)
+
+// WithAuth adds the credentials of cfg, they are only sent to the hosts of origins
+// or to cfg.Hosts.
+func WithAuth(cfg task.AuthConfig, origins ...string) ClientOption {
+	return func(s *clientSetup) {
+		s.wrap = append(s.wrap, func(rt http.RoundTripper) http.RoundTripper {
+			if a := newAuthTransport(rt, cfg, origins...); a != nil {
+				return a
+			}
+			return rt
+		})
+	}
+}
+
+// WithCookieJar keeps the cookies of every response for the next requests.
+func WithCookieJar(jar http.CookieJar) ClientOption {
+	return func(s *clientSetup) {
+		s.jar = jar
+	}
+}
+
+// WithRequest sends the method, body, headers and query of cfg.
+func WithRequest(cfg task.RequestConfig) ClientOption {
+	return func(s *clientSetup) {
+		s.request = cfg
+	}
+}
+
+// WithRequestVars lets f fill the job fields of RequestVars, like the segment index.
+func WithRequestVars(f func(*RequestVars)) ClientOption {
+	return func(s *clientSetup) {
+		s.vars = f
+	}
+}
+
+// WithSigner runs s before every attempt, after the signer of the request config.
+func WithSigner(s Signer) ClientOption {
+	return func(cs *clientSetup) {
+		cs.signer = s
+	}
+}
+
+// ConfigOptions returns the client options of cfg for a job downloading from origins.
+func ConfigOptions(cfg *task.Config, origins ...string) []ClientOption {
+	// the server name override is meant for the job url, not for its mirrors
+	opts := []ClientOption{WithAuth(cfg.Auth, origins...), WithProxy(cfg.Proxy), WithTLS(cfg.TLS, origins[:min(len(origins), 1)]...),
+		WithNetwork(cfg.Network), WithRequest(cfg.Request)}
+	// the session cookies of the playlist and key servers reach the segments even
+	// without a cookie file
+	jar, err := SharedCookieJar(cfg.Auth.CookieFile)
+	if err != nil {
+		zap.L().Warn("load cookies failed", zap.String("file", cfg.Auth.CookieFile), zap.Error(err))
+		jar, _ = SharedCookieJar("")
+	}
+	return append(opts, WithCookieJar(jar))
+}
+
+func NewClient(ctx context.Context, maxRetry int, connTimeOut time.Duration, idleTimeOut time.Duration, opts ...ClientOption) MyClient {
 	ctx, cancel := context.WithCancel(ctx)
 
-	transport := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		DialContext:         (&net.Dialer{Timeout: connTimeOut}).DialContext,
-		MaxIdleConnsPerHost: 100,
-		MaxIdleConns:        100,
-		IdleConnTimeout:     idleTimeOut,
+	setup := &clientSetup{
+		transport: transportConfig{ConnTimeout: connTimeOut, IdleTimeout: idleTimeOut},
+	}
+	for _, opt := range opts {
+		opt(setup)
+	}
+	var rt http.RoundTripper = sharedTransport(setup.transport)
+	if setup.transport.TLS.ServerName != "" && len(setup.serverNameHosts) > 0 {
+		plain := setup.transport
+		plain.TLS.ServerName = ""
+		rt = &serverNameTransport{hosts: setup.serverNameHosts, named: rt, plain: sharedTransport(plain)}
+	}
+	for _, wrap := range setup.wrap {
+		rt = wrap(rt)
+	}
+	request, err := newRequestTemplate(setup.request)
+	var signers []Signer
+	if request != nil && request.signer != nil {
+		signers = append(signers, request.signer)
+	}
+	if setup.signer != nil {
+		signers = append(signers, setup.signer)
 	}
 	return &myClient{
 		client: &http.Client{
-			Transport: transport,
+			Transport: rt,
+			Jar:       setup.jar,
 		},
 		maxRetries: maxRetry,
 		ctx:        ctx,
 		cancel:     cancel,
+		request:    request,
+		requestErr: err,
+		vars:       setup.vars,
+		signers:    signers,
 	}
 }
 
+// Do sends req with retries. The request is cancelled by its own context and by the
+// client context, with a task.CancelledError. A request failing every retry returns a
+// NetworkError.
 func (c *myClient) Do(req *http.Request) (*http.Response, error) {
 	var resp *http.Response
 	var err error
 	retries := 0
-	req = req.WithContext(c.ctx)
+	req, release := c.bind(req)
+	ctx := req.Context()
+	bound := false
+	defer func() {
+		if !bound {
+			release()
+		}
+	}()
 
 	for retries <= c.maxRetries {
+		if retries > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		for _, sign := range c.signers {
+			if err = sign(req); err != nil {
+				return nil, fmt.Errorf("sign request: %w", err)
+			}
+		}
 		resp, err = c.client.Do(req)
 		if err == nil {
+			resp.Body = &boundBody{ReadCloser: resp.Body, release: release}
+			bound = true
 			return resp, nil
 		}
 		zap.L().Debug("retrying", zap.Int("retries", retries), zap.Error(err))
@@ -59,17 +182,53 @@ func (c *myClient) Do(req *http.Request) (*http.Response, error) {
 			retries++
 		}
 		select {
-		case <-c.ctx.Done():
-			return nil, nil
+		case <-ctx.Done():
+			return nil, task.Cancelled(ctx)
 		case <-time.After(time.Second):
 		}
 	}
 	zap.L().Error("connect failed", zap.Error(err))
-	return nil, err
+	return nil, &NetworkError{URL: req.URL.Redacted(), Err: err}
+}
+
+// bind makes the client context cancel req too, release drops the link once the
+// response is read.
+func (c *myClient) bind(req *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(c.ctx, cancel)
+	return req.WithContext(ctx), func() {
+		stop()
+		cancel()
+	}
+}
+
+// boundBody releases the context of its request on Close.
+type boundBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *boundBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
 }
 
 func (c *myClient) NewRequest(url string, headerCfg map[string]string) (*http.Request, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	if c.requestErr != nil {
+		return nil, c.requestErr
+	}
+	var vars RequestVars
+	if c.vars != nil {
+		c.vars(&vars)
+	}
+	var req *http.Request
+	var err error
+	if c.request != nil {
+		req, err = c.request.newRequest(url, &vars)
+	} else {
+		req, err = http.NewRequest("GET", url, nil)
+	}
 	if err != nil {
 		zap.L().Error("new req failed", zap.Error(err))
 		return nil, err
@@ -87,8 +246,13 @@ func (c *myClient) NewRequest(url string, headerCfg map[string]string) (*http.Re
 	headers.Range(func(key string, value interface{}) bool {
 		req.Header.Set(key, value.(string))
 		zap.L().Debug("set header", zap.String("key", key), zap.String("value", value.(string)))
-		return false
+		return true
 	})
+	if c.request != nil {
+		if err = c.request.setHeaders(req, &vars); err != nil {
+			return nil, err
+		}
+	}
 	return req, nil
 }
 
@@ -0,0 +1,27 @@
+package download
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_clientNewRequestHeaders(t *testing.T) {
+	c := NewClient(context.Background(), 0, time.Second, time.Second)
+	// the range over them used to stop after the first, Origin and X-Token were dropped
+	headers := map[string]string{
+		"Referer":    "https://site.example/play",
+		"Origin":     "https://site.example",
+		"X-Token":    "secret",
+		"User-Agent": "hls-test",
+	}
+	req, err := c.NewRequest("http://example.com/movie.ts", headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		if got := req.Header.Get(k); got != v {
+			t.Errorf("header %s = %q, want %q", k, got, v)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jarLock sync.Mutex
+	jars    = make(map[string]http.CookieJar)
+)
+
+// SharedCookieJar returns the jar loaded from the cookies.txt file name, every job of
+// the process gets the same one so a Set-Cookie is seen by the following segments.
+// An empty name returns the shared jar without a file.
+func SharedCookieJar(name string) (http.CookieJar, error) {
+	if name != "" {
+		if abs, err := filepath.Abs(name); err == nil {
+			name = abs
+		}
+	}
+	jarLock.Lock()
+	defer jarLock.Unlock()
+	if jar, ok := jars[name]; ok {
+		return jar, nil
+	}
+	var jar http.CookieJar
+	var err error
+	if name == "" {
+		jar, err = cookiejar.New(nil)
+	} else {
+		jar, err = LoadCookieFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	jars[name] = jar
+	return jar, nil
+}
+
+// LoadCookieFile reads a Netscape cookies.txt as written by curl and the browser exporters.
+func LoadCookieFile(name string) (http.CookieJar, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		httpOnly := false
+		if strings.HasPrefix(text, "#HttpOnly_") {
+			text = strings.TrimPrefix(text, "#HttpOnly_")
+			httpOnly = true
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("%s:%d: expect 7 tab separated fields, got %d", name, line, len(fields))
+		}
+		domain, path := fields[0], fields[2]
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     path,
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = domain
+		}
+		if exp, err := strconv.ParseInt(fields[4], 10, 64); err == nil && exp > 0 {
+			cookie.Expires = time.Unix(exp, 0)
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		u := &url.URL{Scheme: scheme, Host: strings.TrimPrefix(domain, "."), Path: path}
+		jar.SetCookies(u, []*http.Cookie{cookie})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
@@ -0,0 +1,83 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_cookieJar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			if c, err := r.Cookie("login"); err != nil || c.Value != "yes" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "visit", Value: "v1", Path: "/"})
+		case "/segment":
+			if c, err := r.Cookie("visit"); err != nil || c.Value != "v1" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		case "/key":
+			if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}
+	}))
+	defer server.Close()
+
+	name := filepath.Join(t.TempDir(), "cookies.txt")
+	content := "# Netscape HTTP Cookie File\n" +
+		"#HttpOnly_127.0.0.1\tFALSE\t/\tFALSE\t0\tlogin\tyes\n" +
+		"other.example\tFALSE\t/\tFALSE\t0\tlogin\tno\n"
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jar, err := SharedCookieJar(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := SharedCookieJar(name); again != jar {
+		t.Fatal("jar not shared")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the key is fetched by another client, as a segment job would do
+	playlist := NewClient(ctx, 0, time.Second, time.Second, WithCookieJar(jar))
+	key := NewClient(ctx, 0, time.Second, time.Second, WithCookieJar(jar))
+	if resp := get(t, playlist, server.URL+"/index.m3u8"); resp.StatusCode != http.StatusOK {
+		t.Fatal("playlist", resp.Status)
+	}
+	if resp := get(t, key, server.URL+"/key"); resp.StatusCode != http.StatusOK {
+		t.Fatal("key", resp.Status)
+	}
+
+	// without a file the jobs still share the session cookies
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	login := NewClient(ctx, 0, time.Second, time.Second, ConfigOptions(cfg, server.URL)...)
+	if resp := get(t, login, server.URL+"/login"); resp.StatusCode != http.StatusOK {
+		t.Fatal("login", resp.Status)
+	}
+	segment := NewClient(ctx, 0, time.Second, time.Second, ConfigOptions(cfg, server.URL)...)
+	if resp := get(t, segment, server.URL+"/segment"); resp.StatusCode != http.StatusOK {
+		t.Fatal("segment", resp.Status)
+	}
+
+	if err = os.WriteFile(name, []byte("bad line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadCookieFile(name); err == nil {
+		t.Fatal("want error")
+	}
+}
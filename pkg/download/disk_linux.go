@@ -0,0 +1,35 @@
+//go:build linux
+
+package download
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to the user on the filesystem of dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return -1, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// allocated returns the bytes the filesystem holds for the file of info, less than its
+// size while the file has holes.
+func allocated(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
+
+// preallocate reserves size bytes for file so a full disk fails before the download starts.
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return file.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package download
+
+import (
+	"os"
+)
+
+// freeSpace is unknown on this platform.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
+
+// allocated takes the file as written, holes are not detected on this platform.
+func allocated(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// preallocate only sets the size, the filesystem may still allocate lazily.
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,114 @@
+package download
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// EncodingDecode offers gzip, deflate, br and zstd and writes the decoded file.
+	EncodingDecode = "decode"
+	// EncodingRaw offers the same encodings and writes the encoded bytes as they come.
+	EncodingRaw = "raw"
+	// EncodingIdentity asks the server not to encode at all.
+	EncodingIdentity = "identity"
+)
+
+const acceptEncodings = "gzip, deflate, br, zstd"
+
+// setAcceptEncoding fills Accept-Encoding, ranged requests always ask for identity
+// because the offsets refer to the stored bytes. Setting the header also keeps the
+// transport from decoding gzip behind our back.
+func setAcceptEncoding(req *http.Request, mode string) {
+	if req.Header.Get("Range") != "" || mode == EncodingIdentity {
+		req.Header.Set("Accept-Encoding", "identity")
+		return
+	}
+	req.Header.Set("Accept-Encoding", acceptEncodings)
+}
+
+// contentEncodings returns the codings applied to resp in the order they were applied,
+// identity is left out.
+func contentEncodings(resp *http.Response) []string {
+	var list []string
+	for _, v := range resp.Header.Values("Content-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e != "" && e != "identity" {
+				list = append(list, e)
+			}
+		}
+	}
+	return list
+}
+
+// decodeBody undoes the encodings of resp, the last applied is removed first.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	var body io.ReadCloser = resp.Body
+	encodings := contentEncodings(resp)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, err := newDecoder(encodings[i], body)
+		if err != nil {
+			return nil, err
+		}
+		body = r
+	}
+	return body, nil
+}
+
+// decoder closes the decoder and the reader below it.
+type decoder struct {
+	io.Reader
+	close func()
+	under io.Closer
+}
+
+func (d *decoder) Close() error {
+	if d.close != nil {
+		d.close()
+	}
+	return d.under.Close()
+}
+
+func newDecoder(encoding string, r io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &decoder{Reader: zr, close: func() { _ = zr.Close() }, under: r}, nil
+	case "deflate":
+		// deflate should be zlib wrapped, some servers send the raw stream
+		br := bufio.NewReader(r)
+		head, err := br.Peek(2)
+		if err == nil && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			return &decoder{Reader: zr, close: func() { _ = zr.Close() }, under: r}, nil
+		}
+		fr := flate.NewReader(br)
+		return &decoder{Reader: fr, close: func() { _ = fr.Close() }, under: r}, nil
+	case "br":
+		return &decoder{Reader: brotli.NewReader(r), under: r}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &decoder{Reader: zr, close: zr.Close, under: r}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
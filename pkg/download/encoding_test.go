@@ -0,0 +1,162 @@
+package download
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/chestnutsj/hls/pkg/task"
+	"github.com/klauspost/compress/zstd"
+)
+
+func encode(encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		w, _ = zstd.NewWriter(&buf)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// encodingServer encodes whole responses with encoding when the client accepts it,
+// ranged responses are served as they are stored. Without ranges every response is
+// the whole file.
+func encodingServer(t *testing.T, encoding string, data []byte, ranges bool) *httptest.Server {
+	header := strings.TrimPrefix(encoding, "raw-")
+	encoded := encode(encoding, data)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ranges {
+			r.Header.Del("Range")
+		}
+		if r.Header.Get("Range") != "" {
+			if r.Header.Get("Accept-Encoding") != "identity" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), header) {
+			if !ranges {
+				w.Write(data)
+				return
+			}
+			http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		w.Header().Set("Content-Encoding", header)
+		if ranges {
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+		w.Write(encoded)
+	}))
+}
+
+func Test_Job_ContentEncoding(t *testing.T) {
+	data := []byte(textGenerator(100000))
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate", "br", "zstd"} {
+		for _, mode := range []string{EncodingDecode, EncodingRaw, EncodingIdentity} {
+			t.Run(encoding+"/"+mode, func(t *testing.T) {
+				server := encodingServer(t, encoding, data, false)
+				defer server.Close()
+
+				file := filepath.Join(t.TempDir(), "data")
+				cfg := task.NewDownloadConfig()
+				cfg.RetryCount = 0
+				cfg.ContentEncoding = mode
+				u, _ := url.Parse(server.URL)
+				if err := NewHttpTask(context.Background(), u, file, true, cfg, nil).Start(); err != nil {
+					t.Fatal(err)
+				}
+				got, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := data
+				if mode == EncodingRaw {
+					want = encode(encoding, data)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatal("content differs", len(got), len(want))
+				}
+			})
+		}
+	}
+}
+
+func Test_Job_RangesAskIdentity(t *testing.T) {
+	data := []byte(textGenerator(300000))
+	server := encodingServer(t, "gzip", data, true)
+	defer server.Close()
+
+	// identity keeps the size and the ranges
+	file := filepath.Join(t.TempDir(), "data")
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.ChunkSize = 50000
+	cfg.ContentEncoding = EncodingIdentity
+	u, _ := url.Parse(server.URL)
+	if err := NewHttpTask(context.Background(), u, file, true, cfg, nil).Start(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(file)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("content differs", len(got), err)
+	}
+}
+
+func Test_Job_ProbeAsksIdentity(t *testing.T) {
+	data := []byte(textGenerator(300000))
+	var ranged atomic.Int32
+	inner := encodingServer(t, "gzip", data, true)
+	defer inner.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+		}
+		inner.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// the default decode mode still splits a server that gzips on request into ranges
+	file := filepath.Join(t.TempDir(), "data")
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.ChunkSize = 50000
+	cfg.ThreadSize = 3
+	u, _ := url.Parse(server.URL)
+	if err := NewHttpTask(context.Background(), u, file, true, cfg, nil).Start(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(file)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("content differs", len(got), err)
+	}
+	if n := ranged.Load(); n < 6 {
+		t.Fatal("ranged requests", n)
+	}
+}
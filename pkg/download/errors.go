@@ -0,0 +1,83 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// StatusError is a response with a status the download can not use.
+type StatusError struct {
+	URL    string
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s resp is failed code:%s", e.URL, e.Status)
+}
+
+// IsExpired reports whether err is a 401 or a 403, the answer to an expired signed url.
+func IsExpired(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && (se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden)
+}
+
+// NetworkError is a server that could not be reached or a connection that failed
+// after the retries.
+type NetworkError struct {
+	URL string
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("%s: %v", e.URL, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// DiskError is the output file that could not be created, reserved or written.
+type DiskError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *DiskError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *DiskError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumError is a downloaded file that does not match its size or hash.
+type ChecksumError struct {
+	Path string
+	// Hash is the algorithm, size or pieces
+	Hash string
+	Got  string
+	Want string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s %s mismatch: got %s want %s", e.Path, e.Hash, e.Got, e.Want)
+}
+
+// Retryable reports whether a job failing with err may succeed when run again: a
+// server error, a timeout or rate limit, a lost connection or a corrupt file.
+func Retryable(err error) bool {
+	var status *StatusError
+	var disk *DiskError
+	switch {
+	case !task.DefaultRetryable(err), errors.As(err, &disk):
+		return false
+	case errors.As(err, &status):
+		return status.Code >= 500 || status.Code == http.StatusRequestTimeout || status.Code == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_Job_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		default:
+			_, _ = w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + ln.Addr().String() + "/file"
+	_ = ln.Close()
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err = os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var status *StatusError
+	var network *NetworkError
+	var disk *DiskError
+	var invalid *task.ValidationError
+	var cancelled *task.CancelledError
+	for _, c := range []struct {
+		name   string
+		url    string
+		output string
+		target interface{}
+	}{
+		{"status", server.URL + "/missing", "", &status},
+		{"network", closed, "", &network},
+		{"disk", server.URL + "/file", filepath.Join(blocker, "out"), &disk},
+		{"validation", "gopher://host/file", "", &invalid},
+		{"cancelled", server.URL + "/slow", "", &cancelled},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := task.NewDownloadConfig()
+			cfg.RetryCount = 0
+			u, _ := url.Parse(c.url)
+			output := c.output
+			if output == "" {
+				output = t.TempDir() + string(os.PathSeparator)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.name == "cancelled" {
+				time.AfterFunc(200*time.Millisecond, cancel)
+			}
+			err := NewHttpTask(ctx, u, output, false, cfg, nil).Start()
+			if !errors.As(err, c.target) {
+				t.Fatalf("got %T %v", err, err)
+			}
+		})
+	}
+	if status.Code != http.StatusNotFound {
+		t.Fatal("status", status.Code)
+	}
+	if !errors.Is(cancelled, context.Canceled) {
+		t.Fatal("cancelled does not unwrap to context.Canceled")
+	}
+}
+
+func Test_clientContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	type key struct{}
+	for name, ctx := range map[string]context.Context{
+		"todo":  context.TODO(),
+		"value": context.WithValue(context.Background(), key{}, 1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the request is not bound to the client context, Cancel still stops it
+			client := NewClient(context.Background(), 0, time.Second, time.Second)
+			req, err := client.NewRequest(server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.AfterFunc(100*time.Millisecond, client.Cancel)
+			_, err = client.Do(req.WithContext(ctx))
+			if !task.IsCancelled(err) {
+				t.Fatalf("got %T %v", err, err)
+			}
+		})
+	}
+}
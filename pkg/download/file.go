@@ -1,11 +1,12 @@
 package download
 
 import (
+	"fmt"
 	"go.uber.org/zap"
-	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 type FileData interface {
@@ -14,12 +15,29 @@ type FileData interface {
 	GetDataLen() int
 	GetStart() int64
 	GetOffsetLen() int64
+	// Release hands the buffer back to the pool, the data must not be used afterwards.
+	Release()
+}
+
+// readBufferSize is the size of the pooled read buffers.
+const readBufferSize = 64 * 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, readBufferSize)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufPool.Get().(*[]byte)
 }
 
 type fileData struct {
 	pos   int64
 	data  []byte
 	start int64
+	buf   *[]byte
 }
 
 func (f *fileData) GetPos() int64 {
@@ -39,31 +57,134 @@ func (f *fileData) GetOffsetLen() int64 {
 	return (f.pos - f.start) + int64(len(f.data))
 }
 
+func (f *fileData) Release() {
+	if f.buf != nil {
+		bufPool.Put(f.buf)
+		f.buf = nil
+		f.data = nil
+	}
+}
+
+// NewFileData copies data, use newPooledFileData to hand over a pooled buffer instead.
 func NewFileData(pos int64, data []byte, start int64) FileData {
+	if len(data) <= readBufferSize {
+		buf := getBuffer()
+		n := copy(*buf, data)
+		return newPooledFileData(pos, buf, n, start)
+	}
 	val := make([]byte, len(data))
 	copy(val, data)
 	return &fileData{pos: pos, data: val, start: start}
 }
 
+// newPooledFileData takes the ownership of buf, it goes back to the pool on Release.
+func newPooledFileData(pos int64, buf *[]byte, n int, start int64) FileData {
+	return &fileData{pos: pos, data: (*buf)[:n], start: start, buf: buf}
+}
+
+// flushMarker is passed through writeChan to wait until everything before it is written.
+type flushMarker struct {
+	fileData
+	done chan struct{}
+}
+
+const (
+	// SyncNone records the progress right after the write, a system crash may lose data that is marked done.
+	SyncNone = "none"
+	// SyncInterval fsyncs the file every interval and records the progress after it.
+	SyncInterval = "interval"
+	// SyncAlways fsyncs the file after every write.
+	SyncAlways = "always"
+)
+
 type Chunk struct {
 	path      string
 	file      *os.File
 	writeChan chan FileData
 	sync.Mutex
 	status *Progress
+	exited chan struct{}
+
+	syncPolicy   string
+	syncInterval time.Duration
+	lastSync     time.Time
+	// progress written but not synced yet, range start -> length
+	pending map[int64]int64
+	err     error
+	onError func(error)
 }
 
 func NewChunk(path string, status *Progress) (*Chunk, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return nil, err
+		return nil, &DiskError{Op: "create", Path: path, Err: err}
 	}
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
-		return nil, err
+		return nil, &DiskError{Op: "create", Path: path, Err: err}
 	}
 
 	writeChan := make(chan FileData, 100)
-	return &Chunk{path: path, file: file, writeChan: writeChan, status: status}, nil
+	return &Chunk{
+		path:         path,
+		file:         file,
+		writeChan:    writeChan,
+		status:       status,
+		exited:       make(chan struct{}),
+		syncPolicy:   SyncInterval,
+		syncInterval: time.Second,
+		lastSync:     time.Now(),
+		pending:      make(map[int64]int64),
+	}, nil
+}
+
+// SetSyncPolicy chooses when the progress of written data is recorded, see SyncNone,
+// SyncInterval and SyncAlways. The data is always on disk before its progress record.
+func (c *Chunk) SetSyncPolicy(policy string, interval time.Duration) {
+	switch policy {
+	case SyncNone, SyncAlways:
+		c.syncPolicy = policy
+	default:
+		c.syncPolicy = SyncInterval
+	}
+	if interval > 0 {
+		c.syncInterval = interval
+	}
+}
+
+// OnError is called once when writing fails, the rest of the queue is discarded.
+func (c *Chunk) OnError(f func(error)) {
+	c.onError = f
+}
+
+// Err returns the write error, valid once Run has returned.
+func (c *Chunk) Err() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+// Reserve fails when the disk can't hold the rest of the file of size bytes, with
+// prealloc the space is allocated up front.
+func (c *Chunk) Reserve(size int64, prealloc bool) error {
+	info, err := c.file.Stat()
+	if err != nil {
+		return &DiskError{Op: "reserve", Path: c.path, Err: err}
+	}
+	// an interrupted file may have its full size and still holes
+	if need := size - allocated(info); need > 0 {
+		free, err := freeSpace(filepath.Dir(c.path))
+		if err != nil {
+			zap.L().Warn("can't get free space", zap.String("filename", c.path), zap.Error(err))
+		} else if free >= 0 && free < need {
+			return &DiskError{Op: "reserve", Path: c.path, Err: fmt.Errorf("needs %d bytes, only %d free", need, free)}
+		}
+	}
+	if prealloc {
+		if err = preallocate(c.file, size); err != nil {
+			return &DiskError{Op: "preallocate", Path: c.path, Err: err}
+		}
+	}
+	return nil
 }
 
 func (c *Chunk) Close() error {
@@ -74,32 +195,95 @@ func (c *Chunk) Exit() {
 	close(c.writeChan)
 }
 
+// Flush waits until the data queued so far is in the file.
+func (c *Chunk) Flush() error {
+	marker := &flushMarker{done: make(chan struct{})}
+	select {
+	case c.writeChan <- marker:
+	case <-c.exited:
+		return fmt.Errorf("%s writer has exited", c.path)
+	}
+	select {
+	case <-marker.done:
+		return c.Err()
+	case <-c.exited:
+		return fmt.Errorf("%s writer has exited", c.path)
+	}
+}
+
 func (c *Chunk) Run() {
-	defer c.file.Sync()
+	defer close(c.exited)
+	defer c.commit()
 	var err error
 	for data := range c.writeChan {
+		if marker, ok := data.(*flushMarker); ok {
+			c.commit()
+			close(marker.done)
+			continue
+		}
 		err = c.saveData(data)
 		if err != nil {
 			zap.L().Error("file error", zap.String("filename", c.path), zap.Error(err))
+			data.Release()
+			c.fail(err)
 			return
 		}
-		if c.status != nil {
-			c.status.UpdateStatus(data)
+		if c.status == nil {
+			data.Release()
+			continue
+		}
+		c.status.Show(data)
+		if l := data.GetOffsetLen(); l > c.pending[data.GetStart()] {
+			c.pending[data.GetStart()] = l
+		}
+		data.Release()
+		switch c.syncPolicy {
+		case SyncNone, SyncAlways:
+			c.commit()
+		default:
+			if time.Since(c.lastSync) >= c.syncInterval {
+				c.commit()
+			}
 		}
 	}
 }
 
-func (c *Chunk) saveData(data FileData) error {
+// fail stops the producers and drains the queue so none of them blocks on a full channel.
+func (c *Chunk) fail(err error) {
 	c.Lock()
-	defer c.Unlock()
-	_, err := c.file.Seek(data.GetPos(), io.SeekStart)
-	if err != nil {
+	c.err = &DiskError{Op: "write", Path: c.path, Err: err}
+	c.Unlock()
+	if c.onError != nil {
+		c.onError(c.err)
+	}
+	for data := range c.writeChan {
+		if marker, ok := data.(*flushMarker); ok {
+			close(marker.done)
+		}
+		data.Release()
+	}
+}
 
-		return err
+// commit makes the written data durable and only then records its progress.
+func (c *Chunk) commit() {
+	if c.syncPolicy != SyncNone {
+		if err := c.file.Sync(); err != nil {
+			zap.L().Error("sync failed", zap.String("filename", c.path), zap.Error(err))
+			return
+		}
 	}
-	_, err = c.file.Write(data.GetData())
-	if err != nil {
-		return err
+	c.lastSync = time.Now()
+	if c.status == nil {
+		return
 	}
-	return nil
+	for start, length := range c.pending {
+		c.status.Record(start, length)
+		delete(c.pending, start)
+	}
+}
+
+// saveData writes with pwrite, the writes don't share a file offset.
+func (c *Chunk) saveData(data FileData) error {
+	_, err := c.file.WriteAt(data.GetData(), data.GetPos())
+	return err
 }
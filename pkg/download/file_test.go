@@ -3,14 +3,17 @@ package download
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/chestnutsj/hls/pkg/log"
 	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func textGenerator(length int) string {
@@ -96,3 +99,112 @@ func Test_Chunk(t *testing.T) {
 		t.Fatal("data not the same")
 	}
 }
+
+func Test_ChunkSync(t *testing.T) {
+	err := log.DevLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	prof := NewProgress(nil)
+	err = prof.InitCache(filepath.Join(dir, "sync.bin"), statusSuffix, []byte("meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prof.Close()
+
+	chunk, err := NewChunk(filepath.Join(dir, "sync.bin"), prof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunk.Close()
+	chunk.SetSyncPolicy(SyncInterval, time.Hour)
+	go chunk.Run()
+
+	data := []byte(textGenerator(300))
+	chunk.writeChan <- NewFileData(0, data[:100], 0)
+	chunk.writeChan <- NewFileData(100, data[100:200], 0)
+	chunk.writeChan <- NewFileData(200, data[200:], 200)
+
+	recorded := func() map[int64]int64 {
+		return prof.GetTasks(400, 1000)
+	}
+	// nothing is recorded before the file is synced
+	<-time.After(50 * time.Millisecond)
+	if tasks := recorded(); len(tasks) != 1 || tasks[0] != 400 {
+		t.Fatal("progress recorded before sync", tasks)
+	}
+	if err = chunk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := recorded(); len(tasks) != 1 || tasks[300] != 400 {
+		t.Fatal("progress not recorded after sync", tasks)
+	}
+	chunk.Exit()
+}
+
+func Test_ChunkWriteError(t *testing.T) {
+	err := log.DevLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := NewChunk(filepath.Join(t.TempDir(), "broken.bin"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported error
+	chunk.OnError(func(err error) { reported = err })
+	// every write fails from now on
+	_ = chunk.file.Close()
+	go chunk.Run()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			chunk.writeChan <- NewFileData(int64(i), []byte("x"), 0)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("producer blocked on a failed writer")
+	}
+	if err = chunk.Flush(); err == nil {
+		t.Fatal("flush should report the write error")
+	}
+	chunk.Exit()
+	<-chunk.exited
+	if chunk.Err() == nil || reported == nil {
+		t.Fatal("write error not reported")
+	}
+}
+
+func Test_ChunkReserve(t *testing.T) {
+	chunk, err := NewChunk(filepath.Join(t.TempDir(), "reserve.bin"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunk.Close()
+	if err = chunk.Reserve(4096, true); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := chunk.file.Stat()
+	if info.Size() != 4096 {
+		t.Fatal("not preallocated", info.Size())
+	}
+	if free, _ := freeSpace(t.TempDir()); free >= 0 {
+		if err = chunk.Reserve(free*2+1<<40, false); err == nil {
+			t.Fatal("want no space error")
+		}
+		// a sparse file left by an interrupted run has its size but not the space
+		size := free + 1<<30
+		if err = chunk.file.Truncate(size); err != nil {
+			t.Skip("no sparse file", err)
+		}
+		var disk *DiskError
+		if err = chunk.Reserve(size, false); !errors.As(err, &disk) {
+			t.Fatal("want no space error for the holes", err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpSource reads ftp:// urls, ranges are sent as REST before RETR. Every Open has
+// its own control connection so the threads of a transfer run in parallel.
+type ftpSource struct {
+	addr     string
+	path     string
+	user     string
+	password string
+	timeout  time.Duration
+}
+
+func newFTPSource(_ context.Context, u *url.URL, cfg *task.Config) (Source, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("ftp url %s has no host", u.Redacted())
+	}
+	s := &ftpSource{
+		addr: hostPort(u, "21"),
+		// like curl the path is relative to the login directory, //path is absolute
+		path:    strings.TrimPrefix(u.Path, "/"),
+		timeout: 30 * time.Second,
+	}
+	s.user, s.password = urlCredentials(u, cfg)
+	if s.user == "" {
+		s.user, s.password = "anonymous", "anonymous"
+	}
+	if cfg != nil && cfg.ConnTimeout > 0 {
+		s.timeout = time.Duration(cfg.ConnTimeout) * time.Second
+	}
+	return s, nil
+}
+
+// hostPort returns the host and port of u, port when it has none.
+func hostPort(u *url.URL, port string) string {
+	if p := u.Port(); p != "" {
+		port = p
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// urlCredentials returns the user of the url, or the one of cfg.Auth for its host.
+func urlCredentials(u *url.URL, cfg *task.Config) (string, string) {
+	if u.User != nil {
+		password, _ := u.User.Password()
+		return u.User.Username(), password
+	}
+	if cfg == nil {
+		return "", ""
+	}
+	if a := newAuthTransport(nil, cfg.Auth, u.String()); a != nil {
+		if user, password, ok := a.credentialsFor(u.Hostname()); ok {
+			return user, password
+		}
+	}
+	return "", ""
+}
+
+func (s *ftpSource) dial(ctx context.Context) (*ftp.ServerConn, error) {
+	conn, err := ftp.Dial(s.addr, ftp.DialWithContext(ctx), ftp.DialWithTimeout(s.timeout),
+		ftp.DialWithShutTimeout(s.timeout))
+	if err != nil {
+		return nil, &NetworkError{URL: "ftp://" + s.addr, Err: err}
+	}
+	if err = conn.Login(s.user, s.password); err != nil {
+		_ = conn.Quit()
+		return nil, fmt.Errorf("ftp login to %s: %w", s.addr, err)
+	}
+	return conn, nil
+}
+
+func (s *ftpSource) Stat(ctx context.Context) (SourceInfo, error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	defer conn.Quit()
+	size, err := conn.FileSize(s.path)
+	if err != nil {
+		return SourceInfo{}, fmt.Errorf("ftp size of %s: %w", s.path, err)
+	}
+	info := SourceInfo{Size: size, Ranges: true, Name: path.Base(s.path)}
+	if t, err := conn.GetTime(s.path); err == nil {
+		info.Tag = fmt.Sprintf("%x-%x", t.UnixNano(), size)
+	}
+	return info, nil
+}
+
+func (s *ftpSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.RetrFrom(s.path, uint64(offset))
+	if err != nil {
+		_ = conn.Quit()
+		return nil, fmt.Errorf("ftp retr %s from %d: %w", s.path, offset, err)
+	}
+	body := &ftpBody{Reader: resp, resp: resp, conn: conn}
+	if length > 0 {
+		body.Reader = io.LimitReader(resp, length)
+	}
+	// a blocked read returns once the request is cancelled
+	body.stop = context.AfterFunc(ctx, func() { _ = resp.SetDeadline(time.Now()) })
+	return body, nil
+}
+
+// ftpBody ends the transfer and the control connection.
+type ftpBody struct {
+	io.Reader
+	resp *ftp.Response
+	conn *ftp.ServerConn
+	stop func() bool
+}
+
+func (b *ftpBody) Close() error {
+	b.stop()
+	// the server answers 426 to a transfer closed before the end
+	_ = b.resp.Close()
+	return b.conn.Quit()
+}
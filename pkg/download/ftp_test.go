@@ -0,0 +1,132 @@
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// ftpServer serves files to user test with password secret, restarts counts the
+// RETR after a REST.
+func ftpServer(t *testing.T, files map[string][]byte) (string, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	restarts := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTP(conn, files, restarts)
+		}
+	}()
+	return ln.Addr().String(), restarts
+}
+
+func serveFTP(conn net.Conn, files map[string][]byte, restarts *atomic.Int32) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 ready")
+	var data net.Listener
+	var rest int64
+	user := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			user = arg
+			reply("331 password please")
+		case "PASS":
+			if user != "test" || arg != "secret" {
+				reply("530 login incorrect")
+				continue
+			}
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n211 End")
+		case "TYPE":
+			reply("200 type set")
+		case "SIZE":
+			if f, ok := files[arg]; ok {
+				reply("213 %d", len(f))
+			} else {
+				reply("550 no such file")
+			}
+		case "MDTM":
+			reply("213 20240102030405")
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			rest, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting")
+		case "RETR":
+			f, ok := files[arg]
+			if !ok || data == nil {
+				reply("550 no such file")
+				continue
+			}
+			if rest > 0 {
+				restarts.Add(1)
+			}
+			reply("150 opening data connection")
+			dc, err := data.Accept()
+			data.Close()
+			data = nil
+			if err != nil {
+				return
+			}
+			_, err = dc.Write(f[rest:])
+			dc.Close()
+			rest = 0
+			if err != nil {
+				reply("426 transfer aborted")
+			} else {
+				reply("226 transfer complete")
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func Test_Job_FTP(t *testing.T) {
+	data := []byte(textGenerator(300000))
+	addr, restarts := ftpServer(t, map[string][]byte{"pub/movie.ts": data})
+
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.ChunkSize = 50000
+	cfg.ThreadSize = 4
+	checkDownload(t, "ftp://test:secret@"+addr+"/pub/movie.ts", cfg, "movie.ts", data)
+	if restarts.Load() == 0 {
+		t.Fatal("ranges were not sent as REST")
+	}
+
+	// the credentials of the config are used without user in the url
+	cfg.Auth.User, cfg.Auth.Password = "test", "secret"
+	checkDownload(t, "ftp://"+addr+"/pub/movie.ts", cfg, "movie.ts", data)
+}
@@ -0,0 +1,178 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/chestnutsj/hls/pkg/log"
+	"github.com/chestnutsj/hls/pkg/task"
+	"go.uber.org/zap"
+)
+
+// httpSource reads an http or https url with MyClient.
+type httpSource struct {
+	client   MyClient
+	url      string
+	header   map[string]string
+	encoding string
+	// naming picks the Name of Stat, see FileNameFor
+	naming string
+}
+
+// NewHTTPSource returns the source reading url with client, the headers, naming and
+// content encoding come from cfg.
+func NewHTTPSource(client MyClient, url string, cfg *task.Config) Source {
+	return &httpSource{client: client, url: url, header: cfg.Headers, encoding: cfg.ContentEncoding, naming: cfg.Naming}
+}
+
+// Stat issues the first GET, the body is not read. It asks for identity so a server
+// compressing on the fly still tells the size and ranges, an encoding is negotiated by
+// the single stream only.
+func (s *httpSource) Stat(ctx context.Context) (SourceInfo, error) {
+	info := SourceInfo{Size: -1}
+	req, err := s.client.NewRequest(s.url, s.header)
+	if err != nil {
+		return info, err
+	}
+	req = req.WithContext(ctx)
+	setAcceptEncoding(req, EncodingIdentity)
+	zap.L().Info("NewRequest", zap.Any("req", req.Header))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return info, &StatusError{URL: s.url, Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	log.Info("resp", zap.Any("header", resp.Header))
+	requested, _ := url.Parse(s.url)
+	info.Name = FileNameFor(resp, requested, s.naming)
+	info.Tag = resp.Header.Get("ETag")
+	contentLength, supportsRange, err := checkRangeSupportAndGetSize(resp)
+	if err != nil {
+		zap.L().Info("check resp failed")
+		contentLength = 0
+		supportsRange = false
+	}
+	if enc := contentEncodings(resp); len(enc) > 0 {
+		// the offsets of an encoded body are not the offsets of the file
+		supportsRange = false
+		if s.encoding != EncodingRaw && s.encoding != EncodingIdentity {
+			// Content-Length counts the encoded bytes, the decoded size is unknown
+			contentLength = 0
+		}
+	} else if resp.Header.Get("Content-Length") == "" {
+		// chunked or close delimited, a range probe may still tell the size
+		size, _, pErr := s.probe(ctx)
+		if pErr == nil {
+			supportsRange = true
+			if size > 0 {
+				contentLength = size
+			}
+		} else {
+			zap.L().Info("size unknown", zap.Error(pErr))
+		}
+	}
+	if contentLength > 0 {
+		info.Size = contentLength
+	}
+	info.Ranges = supportsRange
+	return info, nil
+}
+
+// probe asks for the first byte to learn the size and etag the url serves.
+func (s *httpSource) probe(ctx context.Context) (int64, string, error) {
+	req, err := s.client.NewRequest(s.url, s.header)
+	if err != nil {
+		return 0, "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", "bytes=0-0")
+	setAcceptEncoding(req, s.encoding)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, "", fmt.Errorf("%s does not serve ranges, code %d", s.url, resp.StatusCode)
+	}
+	size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return 0, "", err
+	}
+	return size, resp.Header.Get("ETag"), nil
+}
+
+func (s *httpSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	var end int64
+	if length > 0 {
+		end = offset + length
+	}
+	body, start, err := s.open(ctx, offset, end, -1)
+	if err != nil {
+		return nil, err
+	}
+	if start != offset {
+		_ = body.Close()
+		return nil, fmt.Errorf("%s ignored range request", s.url)
+	}
+	return body, nil
+}
+
+// open returns the body of [start, end) and where it really starts, a server without
+// ranges starts over at from.
+func (s *httpSource) open(ctx context.Context, start, end, from int64) (io.ReadCloser, int64, error) {
+	req, err := s.client.NewRequest(s.url, s.header)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if end != 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+		zap.L().Debug("download", zap.Int64("start", start), zap.Int64("end", end))
+	} else if start > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	setAcceptEncoding(req, s.encoding)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+		_ = resp.Body.Close()
+		return nil, 0, &StatusError{URL: s.url, Code: resp.StatusCode, Status: resp.Status}
+	}
+	if start > 0 && resp.StatusCode != 206 {
+		if end != 0 {
+			_ = resp.Body.Close()
+			return nil, 0, fmt.Errorf("%s ignored range request", s.url)
+		}
+		// a single stream without range support starts over
+		start = from
+	}
+	if enc := contentEncodings(resp); len(enc) > 0 {
+		if req.Header.Get("Range") != "" {
+			_ = resp.Body.Close()
+			return nil, 0, fmt.Errorf("%s encoded a range response with %s", s.url, strings.Join(enc, ", "))
+		}
+		if s.encoding == EncodingDecode {
+			body, err := decodeBody(resp)
+			if err != nil {
+				_ = resp.Body.Close()
+				return nil, 0, err
+			}
+			return body, start, nil
+		}
+	}
+	return resp.Body, start, nil
+}
@@ -1,14 +1,17 @@
 package download
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,13 +33,25 @@ func init() {
 const statusSuffix = ".xz3"
 
 type JobInfo struct {
-	Url        string
+	// Url names the download and its progress, Current is where the requests go after
+	// a refresh of an expired url
+	Url     string
+	Current string `json:",omitempty"`
+	// FileName is empty until the first response names the file in Dir
 	FileName   string
+	Dir        string `json:",omitempty"`
 	SourceFile string
+	Mirrors    []string  `json:",omitempty"`
+	Checksum   *Checksum `json:",omitempty"`
+	// Index and Sequence place a segment in its playlist for the request templates
+	Index    int   `json:",omitempty"`
+	Sequence int64 `json:",omitempty"`
 }
 
 type Job struct {
 	sync.Mutex
+	// parent is the context of the job, Renew derives the next run from it
+	parent     context.Context
 	ctx        context.Context
 	cancel     context.CancelFunc
 	cfg        *task.Config
@@ -46,8 +61,21 @@ type Job struct {
 	status     atomic.Int32
 	jobWg      sync.WaitGroup
 	displayOpt *display.Display
+	limiter    *RateLimiter
+	pause      *Pauser
+	// force overwrites an existing file instead of picking a unique name
+	force bool
+	// refresh is asked for a new url after a 401 or 403, at most refreshes times
+	refresh   Refresh
+	refreshes int
+	// progress and size of the current run, see Transferred
+	progress atomic.Pointer[Progress]
+	size     atomic.Int64
 }
 
+// Refresh returns the url replacing stale, which was refused as expired.
+type Refresh func(ctx context.Context, stale string) (string, error)
+
 func NewHttpTaskByCache(ctx context.Context, displayOpt *display.Display, cfg *task.Config, info []byte) (task.Task, error) {
 	var i JobInfo
 	err := json.Unmarshal(info, &i)
@@ -56,49 +84,143 @@ func NewHttpTaskByCache(ctx context.Context, displayOpt *display.Display, cfg *t
 		return nil, err
 	}
 
+	parent := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	j := &Job{
+		parent:     parent,
 		ctx:        ctx,
 		cancel:     cancel,
 		cfg:        cfg,
 		info:       i,
-		client:     NewClient(ctx, int(cfg.RetryCount), time.Duration(cfg.ConnTimeout)*time.Second, time.Duration(cfg.ConnTimeout)*time.Second),
 		status:     atomic.Int32{},
 		jobWg:      sync.WaitGroup{},
 		displayOpt: displayOpt,
+		limiter:    newJobLimiter(cfg),
 	}
+	j.client = j.newClient()
+	j.pause = NewPauser(ctx)
 
 	j.status.Store(task.Pending)
 	return j, nil
 }
 
-func NewHttpTask(ctx context.Context, url *url.URL, filename string, force bool, cfg *task.Config, displayOpt *display.Display) task.Task {
+// NewHttpTask downloads url into filename, mirrors serving the same file share the range requests.
+// An empty filename or a directory lets the response name the file, see cfg.Naming.
+func NewHttpTask(ctx context.Context, url *url.URL, filename string, force bool, cfg *task.Config, displayOpt *display.Display, mirrors ...*url.URL) task.Task {
+	var dir string
+	if isDirName(filename) {
+		dir, filename = filename, ""
+	}
 	source := filename
+	var mirrorList []string
+	for _, m := range mirrors {
+		if m != nil && m.String() != url.String() {
+			mirrorList = append(mirrorList, m.String())
+		}
+	}
 
-	if !force {
-		filename, _ = tools.GenerateUniqueFilename(filename, statusSuffix)
+	if !force && filename != "" {
+		// a name that can't be checked stays, creating the file reports the error
+		if name, err := tools.GenerateUniqueFilename(filename, statusSuffix); err != nil {
+			zap.L().Warn("can't check file name", zap.String("file", filename), zap.Error(err))
+		} else {
+			filename = name
+		}
 	}
+	parent := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	j := &Job{
+		parent: parent,
 		ctx:    ctx,
 		cancel: cancel,
 		cfg:    cfg,
 		info: JobInfo{
 			Url:        url.String(),
 			FileName:   filename,
+			Dir:        dir,
 			SourceFile: source,
+			Mirrors:    mirrorList,
 		},
-		client: NewClient(ctx, int(cfg.RetryCount), time.Duration(cfg.ConnTimeout)*time.Second, time.Duration(cfg.ConnTimeout)*time.Second),
+		force: force,
 
 		status:     atomic.Int32{},
 		jobWg:      sync.WaitGroup{},
 		displayOpt: displayOpt,
+		limiter:    newJobLimiter(cfg),
 	}
+	j.client = j.newClient()
+	j.pause = NewPauser(ctx)
 
 	j.status.Store(task.Pending)
 	return j
 }
 
+func (j *Job) newClient() MyClient {
+	timeout := time.Duration(j.cfg.ConnTimeout) * time.Second
+	opts := ConfigOptions(j.cfg, append([]string{j.info.Url}, j.info.Mirrors...)...)
+	opts = append(opts, WithRequestVars(func(v *RequestVars) {
+		j.Lock()
+		v.Index, v.Sequence = j.info.Index, j.info.Sequence
+		j.Unlock()
+	}))
+	return NewClient(j.ctx, int(j.cfg.RetryCount), timeout, timeout, opts...)
+}
+
+// Renew returns a pending copy of the job for another run, it continues from the
+// progress on disk and from the refreshed url.
+func (j *Job) Renew() (task.Task, error) {
+	j.Lock()
+	info := j.info
+	j.Unlock()
+	ctx, cancel := context.WithCancel(j.parent)
+	n := &Job{
+		parent:     j.parent,
+		ctx:        ctx,
+		cancel:     cancel,
+		cfg:        j.cfg,
+		info:       info,
+		force:      j.force,
+		displayOpt: j.displayOpt,
+		limiter:    j.limiter,
+		refresh:    j.refresh,
+		refreshes:  j.refreshes,
+	}
+	n.client = n.newClient()
+	n.pause = NewPauser(ctx)
+	n.status.Store(task.Pending)
+	return n, nil
+}
+
+// Transferred returns the bytes of the file on disk and its size, 0 while unknown.
+func (j *Job) Transferred() (int64, int64) {
+	var done int64
+	if p := j.progress.Load(); p != nil {
+		done = p.Done()
+	}
+	return done, j.size.Load()
+}
+
+// SetSegment tells the request templates where the job is in its playlist, call it
+// before Start.
+func (j *Job) SetSegment(index int, sequence int64) {
+	j.Lock()
+	defer j.Unlock()
+	j.info.Index, j.info.Sequence = index, sequence
+}
+
+func newJobLimiter(cfg *task.Config) *RateLimiter {
+	rate, err := ParseRate(cfg.JobRateLimit)
+	if err != nil {
+		log.Warn("ignore job rate limit", zap.Error(err))
+	}
+	return NewRateLimiter(rate)
+}
+
+// SetRateLimit changes the limit of this job only, it can be called while running.
+func (j *Job) SetRateLimit(rate int64) {
+	j.limiter.SetRate(rate)
+}
+
 func (j *Job) GetType() string {
 	return JobType
 }
@@ -110,28 +232,90 @@ func (j *Job) Start() error {
 	var err error
 	defer func() {
 		if j.status.Load() == task.Running {
-			if j.lastErr == nil || err == nil {
+			if err == nil {
 				j.status.Store(task.Completed)
 
-			} else {
+			} else if task.IsCancelled(err) {
 				j.status.Store(task.Aborted)
+			} else {
+				j.status.Store(task.Failed)
 			}
 		}
 		j.cancel()
 	}()
 	j.status.Store(task.Running)
-	err = j.work()
-	j.jobWg.Wait()
-	return err
+	for refreshed := 0; ; refreshed++ {
+		err = j.work()
+		j.jobWg.Wait()
+		if wErr := j.writeErr(); wErr != nil {
+			err = wErr
+		}
+		if err == nil {
+			// Exit or the parent context stopped the transfer early
+			err = task.Cancelled(j.ctx)
+		}
+		if err == nil || !IsExpired(err) || j.refresh == nil || refreshed >= j.refreshes || j.ctx.Err() != nil {
+			return err
+		}
+		stale := j.url()
+		fresh, rErr := j.refresh(j.ctx, stale)
+		if rErr != nil {
+			return fmt.Errorf("%w, refresh failed: %v", err, rErr)
+		}
+		log.Info("url refreshed", zap.String("url", redactURL(fresh)))
+		j.Lock()
+		j.info.Current = fresh
+		j.Unlock()
+	}
+}
+
+// SetRefresh lets the job ask f for a new url when the current one is refused with
+// 401 or 403, the progress is kept. Call it before Start.
+func (j *Job) SetRefresh(f Refresh, times int) {
+	j.refresh = f
+	j.refreshes = times
+}
+
+// redactURL hides the password and the query of a url, a signed url carries its
+// token in the query.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "(invalid url)"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.Redacted()
+}
+
+// url is where the requests go.
+func (j *Job) url() string {
+	j.Lock()
+	defer j.Unlock()
+	if j.info.Current != "" {
+		return j.info.Current
+	}
+	return j.info.Url
 }
 
+func (j *Job) writeErr() error {
+	j.Lock()
+	defer j.Unlock()
+	return j.lastErr
+}
+
+// Stop pauses the job, the requests in flight are cancelled and the progress stays on disk.
 func (j *Job) Stop() error {
 	j.status.Store(task.Paused)
+	j.pause.Pause()
 	return nil
 }
 
+// Resume issues the ranged requests again from where each range stopped.
 func (j *Job) Resume() error {
 	j.status.Store(task.Running)
+	j.pause.Resume()
 	return nil
 }
 
@@ -141,9 +325,47 @@ func (j *Job) Exit() error {
 }
 
 func (j *Job) Extra() ([]byte, error) {
+	j.Lock()
+	defer j.Unlock()
 	return json.Marshal(&j.info)
 }
 
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	return err == nil && os.SameFile(ia, ib)
+}
+
+// isDirName reports whether name is empty, ends with a separator or is an existing directory.
+func isDirName(name string) bool {
+	if name == "" || strings.HasSuffix(name, "/") || strings.HasSuffix(name, string(os.PathSeparator)) {
+		return true
+	}
+	info, err := os.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+// setName places the file name in the output dir.
+func (j *Job) setName(base string) error {
+	name := filepath.Join(j.info.Dir, base)
+	source := name
+	if !j.force {
+		var err error
+		if name, err = tools.GenerateUniqueFilename(name, statusSuffix); err != nil {
+			return &DiskError{Op: "name", Path: source, Err: err}
+		}
+	}
+	j.Lock()
+	j.info.FileName = name
+	j.info.SourceFile = source
+	j.Unlock()
+	zap.L().Info("file named", zap.String("file", name), zap.String("naming", j.cfg.Naming))
+	return nil
+}
+
 func checkRangeSupportAndGetSize(resp *http.Response) (int64, bool, error) {
 	acceptRanges := resp.Header.Get("Accept-Ranges")
 	supportsRange := acceptRanges == "bytes"
@@ -165,55 +387,140 @@ func checkRangeSupportAndGetSize(resp *http.Response) (int64, bool, error) {
 	return contentLength, supportsRange, nil
 }
 
-func (j *Job) work() error {
-	urlStr := j.info.Url
-	req, err := j.client.NewRequest(urlStr, j.cfg.Headers)
-	if err != nil {
-		return err
-	}
-	zap.L().Info("NewRequest", zap.Any("req", req.Header))
+// probeMirror asks a mirror for the first byte to learn the size and etag it serves.
+func (j *Job) probeMirror(u string) (int64, string, error) {
+	src := &httpSource{client: j.client, url: u, header: j.cfg.Headers, encoding: j.cfg.ContentEncoding}
+	return src.probe(j.ctx)
+}
 
-	resp, err := j.client.Do(req)
-	if err != nil {
-		return err
+// mirrorSample is how many bytes of each end of the file are compared when the etags
+// can't be.
+const mirrorSample = 4 << 10
+
+// sample reads the first and the last bytes of the file at u.
+func (j *Job) sample(u string, size int64) ([]byte, error) {
+	src := &httpSource{client: j.client, url: u, header: j.cfg.Headers, encoding: EncodingIdentity}
+	offsets := []int64{0}
+	if size > 2*mirrorSample {
+		offsets = append(offsets, size-mirrorSample)
 	}
-	if resp == nil {
-		return errors.New("resp is empty")
+	var out []byte
+	for _, off := range offsets {
+		body, err := src.Open(j.ctx, off, min(size-off, 2*mirrorSample))
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(io.LimitReader(body, 2*mirrorSample))
+		_ = body.Close()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
 	}
+	return out, nil
+}
 
-	defer resp.Body.Close()
+// addMirrors adds the mirrors that serve the same size and etag as the primary url,
+// without strong etags on both sides the ends of the file must match.
+func (j *Job) addMirrors(transfer *Transfer, size int64, etag string) {
+	var primary []byte
+	for _, u := range j.info.Mirrors {
+		mSize, mTag, err := j.probeMirror(u)
+		if err != nil {
+			log.Warn("skip mirror", zap.String("url", u), zap.Error(err))
+			continue
+		}
+		same, strong := sameETag(etag, mTag)
+		if !strong && mSize == size {
+			if primary == nil {
+				if primary, err = j.sample(j.url(), size); err != nil {
+					log.Warn("can't sample the file, mirrors are skipped", zap.Error(err))
+					return
+				}
+			}
+			mirror, err := j.sample(u, size)
+			same = err == nil && bytes.Equal(primary, mirror)
+		}
+		if mSize != size || !same {
+			log.Warn("skip mirror with different content", zap.String("url", u),
+				zap.Int64("size", mSize), zap.Int64("want", size), zap.String("etag", mTag))
+			continue
+		}
+		transfer.AddMirror(u)
+	}
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("%s resp is %d", urlStr, resp.StatusCode)
+// remote is what the first request tells about the file.
+type remote struct {
+	size   int64
+	ranges bool
+	tag    string
+}
+
+// stat learns the size of the file and names it.
+func (j *Job) stat() (info remote, src Source, err error) {
+	src, err = NewSource(j.ctx, j.url(), j.cfg)
+	if err != nil {
+		return info, nil, err
+	}
+	if src == nil {
+		src = NewHTTPSource(j.client, j.url(), j.cfg)
+	}
+	si, err := src.Stat(j.ctx)
+	if err != nil {
+		closeSource(src)
+		return info, nil, err
+	}
+	if j.info.FileName == "" {
+		name := SanitizeFileName(si.Name)
+		if name == "" {
+			name = defaultName
+		}
+		if err = j.setName(name); err != nil {
+			closeSource(src)
+			return info, nil, err
+		}
+	}
+	if si.Size > 0 {
+		info.size = si.Size
 	}
+	info.ranges = si.Ranges
+	info.tag = si.Tag
+	return info, src, nil
+}
 
-	log.Info("resp", zap.Any("header", resp.Header))
-	contentLength, supportsRange, err := checkRangeSupportAndGetSize(resp)
+func (j *Job) work() error {
+	urlStr := j.url()
+	rem, src, err := j.stat()
 	if err != nil {
-		zap.L().Info("check resp failed")
-		contentLength = 0
-		supportsRange = false
+		return err
+	}
+	defer closeSource(src)
+	contentLength, supportsRange := rem.size, rem.ranges
+	if fs, ok := src.(*fileSource); ok && sameFile(fs.path, j.info.FileName) {
+		zap.L().Info("source is the output file", zap.String("file", j.info.FileName))
+		return nil
 	}
 	zap.L().Info("start download 200", zap.Int64("contentLength", contentLength), zap.Bool("range", supportsRange))
+	if j.info.Checksum != nil && j.info.Checksum.Size > 0 && contentLength > 0 && contentLength != j.info.Checksum.Size {
+		return &ChecksumError{Path: urlStr, Hash: "size", Got: strconv.FormatInt(contentLength, 10),
+			Want: strconv.FormatInt(j.info.Checksum.Size, 10)}
+	}
 	var bar *mpb.Bar
 	if j.displayOpt != nil {
 		bar = j.displayOpt.AddBar(j.info.FileName, int64(contentLength), "down")
 	}
 
 	prof := NewProgress(bar)
-	defer func() {
-		prof.Close()
-		if prof.cache != nil {
-			if err == nil && j.ctx.Err() == nil {
-				_ = os.RemoveAll(prof.cache.GetPath())
-			}
-		}
-	}()
-
+	prof.SetDynamic(contentLength <= 0)
+	j.progress.Store(prof)
+	j.size.Store(max(contentLength, 0))
 	chunk, err := NewChunk(j.info.FileName, prof)
 	if err != nil {
+		prof.Close()
 		return err
 	}
+	chunk.SetSyncPolicy(j.cfg.SyncPolicy, time.Duration(j.cfg.SyncInterval)*time.Second)
 	j.jobWg.Add(1)
 	go func() {
 		defer func() {
@@ -222,11 +529,47 @@ func (j *Job) work() error {
 		}()
 		chunk.Run()
 	}()
-	defer chunk.Exit()
-	transfer := NewTransfer(j.ctx, &j.status, j.client, urlStr, j.cfg.Headers, j.cfg.ChunkSize)
+	defer func() {
+		// the writer records the last progress when it exits
+		chunk.Exit()
+		<-chunk.exited
+		if err == nil && j.ctx.Err() == nil && chunk.Err() == nil {
+			prof.Complete()
+		}
+		prof.Close()
+		if prof.cache != nil {
+			if err == nil && j.ctx.Err() == nil && chunk.Err() == nil {
+				_ = os.RemoveAll(prof.cache.GetPath())
+			}
+		}
+	}()
+	transfer := NewTransfer(j.ctx, j.pause, j.client, urlStr, j.cfg.Headers, j.cfg.ChunkSize)
+	if c := j.info.Checksum; c != nil && len(c.Pieces) > 0 {
+		transfer.AlignSplits(c.PieceLength)
+	}
+	transfer.AddLimiter(j.limiter)
+	if supportsRange {
+		// the offsets of the ranges and of a resumed stream are the stored bytes
+		transfer.SetEncoding(EncodingIdentity)
+	} else {
+		transfer.SetEncoding(j.cfg.ContentEncoding)
+	}
+	transfer.SetSource(urlStr, src)
+	chunk.OnError(func(wErr error) {
+		j.Lock()
+		j.lastErr = wErr
+		j.Unlock()
+		transfer.cancel()
+	})
+	if contentLength > 0 {
+		if err = chunk.Reserve(contentLength, j.cfg.Preallocate); err != nil {
+			return err
+		}
+	}
 	if supportsRange && contentLength > j.cfg.ChunkSize && j.cfg.ThreadSize > 1 {
 		zap.L().Info("start download range")
-		meta, _ := json.Marshal(j.info)
+		// mirrors may change between runs without invalidating the progress
+		meta, _ := json.Marshal(JobInfo{Url: j.info.Url, FileName: j.info.FileName, SourceFile: j.info.SourceFile})
 		err = prof.InitCache(j.info.SourceFile, statusSuffix, meta)
 		if err != nil {
 			return err
@@ -234,18 +577,33 @@ func (j *Job) work() error {
 		jobsMap := prof.GetTasks(contentLength, j.cfg.ChunkSize)
 		if len(jobsMap) == 0 {
 			zap.L().Info("task is download over ")
-			return nil
 		} else {
 			zap.L().Info("reStart download", zap.Int("jobsMap", len(jobsMap)))
+			if _, ok := src.(*httpSource); ok {
+				j.addMirrors(transfer, contentLength, rem.tag)
+			}
+			err = transfer.DownloadMtiThread(chunk.writeChan, j.cfg.ThreadSize, jobsMap)
 		}
-		err = transfer.DownloadMtiThread(chunk.writeChan, j.cfg.ThreadSize, jobsMap)
 
 	} else {
 		zap.L().Info("start download single")
-		err = transfer.DownloadPerThread(chunk.writeChan, 0, 0)
+		var pos int64
+		if contentLength <= 0 && supportsRange {
+			// a stream of unknown size resumes from the bytes already on disk
+			meta, _ := json.Marshal(JobInfo{Url: j.info.Url, FileName: j.info.FileName, SourceFile: j.info.SourceFile})
+			if err = prof.InitCache(j.info.SourceFile, statusSuffix, meta); err != nil {
+				return err
+			}
+			pos = prof.Written()
+		}
+		err = transfer.DownloadStream(chunk.writeChan, pos, contentLength, supportsRange)
 		zap.L().Info("download single exit")
 	}
 
+	if err == nil && j.ctx.Err() == nil && j.info.Checksum != nil {
+		err = j.verify(chunk, transfer, contentLength, supportsRange)
+	}
+
 	if j.ctx.Err() != nil {
 		zap.L().Warn("context canceled")
 		if bar != nil {
@@ -259,3 +617,31 @@ func (j *Job) work() error {
 
 	return err
 }
+
+// verify checks the pieces and then the whole file, broken pieces are fetched once more
+// when the server supports ranges.
+func (j *Job) verify(chunk *Chunk, transfer *Transfer, size int64, supportsRange bool) error {
+	if err := chunk.Flush(); err != nil {
+		return err
+	}
+	bad, err := j.info.Checksum.BadPieces(j.info.FileName, size)
+	if err != nil {
+		return err
+	}
+	if len(bad) > 0 && supportsRange {
+		log.Warn("fetch broken pieces again", zap.String("file", j.info.FileName), zap.Int("pieces", len(bad)))
+		if err = transfer.DownloadMtiThread(chunk.writeChan, j.cfg.ThreadSize, bad); err != nil {
+			return err
+		}
+		if err = chunk.Flush(); err != nil {
+			return err
+		}
+		if bad, err = j.info.Checksum.BadPieces(j.info.FileName, size); err != nil {
+			return err
+		}
+	}
+	if len(bad) > 0 {
+		return &ChecksumError{Path: j.info.FileName, Hash: "pieces", Got: fmt.Sprintf("%d broken", len(bad)), Want: "none"}
+	}
+	return j.info.Checksum.Verify(j.info.FileName)
+}
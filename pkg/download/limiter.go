@@ -0,0 +1,200 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// RateWindow overrides the base rate between Start and End (minutes of the day).
+// A window whose End is before Start wraps midnight.
+type RateWindow struct {
+	Start int
+	End   int
+	Rate  int64
+}
+
+func (w RateWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start <= w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+// RateLimiter is a token bucket measured in bytes per second. A rate <= 0 means unlimited.
+type RateLimiter struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []RateWindow
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, now: time.Now}
+}
+
+var globalLimiter = NewRateLimiter(0)
+
+// GlobalLimiter is shared by every job and segment of the process.
+func GlobalLimiter() *RateLimiter {
+	return globalLimiter
+}
+
+// SetRateLimit changes the process wide limit at runtime.
+func SetRateLimit(rate int64) {
+	globalLimiter.SetRate(rate)
+}
+
+// SetupRateLimit applies the global limit and schedule of cfg.
+func SetupRateLimit(cfg *task.Config) error {
+	rate, err := ParseRate(cfg.RateLimit)
+	if err != nil {
+		return task.Invalid("rate_limit", err)
+	}
+	schedule, err := ParseSchedule(cfg.RateSchedule)
+	if err != nil {
+		return task.Invalid("rate_schedule", err)
+	}
+	globalLimiter.SetRate(rate)
+	globalLimiter.SetSchedule(schedule)
+	return nil
+}
+
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Time{}
+}
+
+func (l *RateLimiter) SetSchedule(schedule []RateWindow) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.schedule = schedule
+}
+
+// Rate returns the limit in effect right now.
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentRate(l.now())
+}
+
+func (l *RateLimiter) currentRate(now time.Time) int64 {
+	for _, w := range l.schedule {
+		if w.contains(now) {
+			return w.Rate
+		}
+	}
+	return l.rate
+}
+
+// reserve takes n tokens and returns how long the caller has to wait for them.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	rate := l.currentRate(now)
+	if rate <= 0 {
+		l.last = time.Time{}
+		return 0
+	}
+	// one second worth of burst
+	burst := float64(rate)
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may be consumed or ctx is done.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ParseRate accepts a plain byte count or a value with K, M or G suffix, e.g. "512K" or "1.5M".
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/S"), "B")
+	if s == "" {
+		return 0, nil
+	}
+	unit := float64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		unit = 1024
+	case 'M':
+		unit = 1024 * 1024
+	case 'G':
+		unit = 1024 * 1024 * 1024
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * unit), nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func ParseSchedule(rules []task.RateRule) ([]RateWindow, error) {
+	windows := make([]RateWindow, 0, len(rules))
+	for _, r := range rules {
+		start, err := parseClock(r.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(r.End)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := ParseRate(r.Limit)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, RateWindow{Start: start, End: end, Rate: rate})
+	}
+	return windows, nil
+}
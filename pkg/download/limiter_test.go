@@ -0,0 +1,92 @@
+package download
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_ParseRate(t *testing.T) {
+	cases := map[string]int64{
+		"":      0,
+		"0":     0,
+		"100":   100,
+		"512K":  512 * 1024,
+		"1.5M":  1024 * 1024 * 3 / 2,
+		"2mb/s": 2 * 1024 * 1024,
+		"1G":    1024 * 1024 * 1024,
+	}
+	for s, want := range cases {
+		got, err := ParseRate(s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if got != want {
+			t.Errorf("%s: %d != %d", s, got, want)
+		}
+	}
+	if _, err := ParseRate("fast"); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func Test_RateLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := NewRateLimiter(100 * 1024)
+	x := time.Now()
+	// the first second is the burst, the next 50K has to wait about half a second
+	for i := 0; i < 15; i++ {
+		if err := l.WaitN(ctx, 10*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait := time.Since(x)
+	if wait < 400*time.Millisecond || wait > 2*time.Second {
+		t.Fatal("limit not work", wait)
+	}
+
+	l.SetRate(0)
+	x = time.Now()
+	_ = l.WaitN(ctx, 1024*1024*1024)
+	if time.Since(x) > 100*time.Millisecond {
+		t.Fatal("unlimited should not wait")
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	l.SetRate(1)
+	_ = l.WaitN(cancelCtx, 1)
+	if err := l.WaitN(cancelCtx, 1024); err == nil {
+		t.Fatal("want context error")
+	}
+}
+
+func Test_RateSchedule(t *testing.T) {
+	schedule, err := ParseSchedule([]task.RateRule{
+		{Start: "22:00", End: "06:00", Limit: "0"},
+		{Start: "09:00", End: "18:00", Limit: "1M"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewRateLimiter(512)
+	l.SetSchedule(schedule)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	cases := map[time.Duration]int64{
+		23 * time.Hour: 0,
+		3 * time.Hour:  0,
+		10 * time.Hour: 1024 * 1024,
+		20 * time.Hour: 512,
+	}
+	for at, want := range cases {
+		l.now = func() time.Time { return day.Add(at) }
+		if r := l.Rate(); r != want {
+			t.Errorf("%s: rate %d != %d", at, r, want)
+		}
+	}
+	if _, err = ParseSchedule([]task.RateRule{{Start: "25:00", End: "01:00"}}); err == nil {
+		t.Fatal("want error")
+	}
+}
@@ -0,0 +1,57 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"github.com/chestnutsj/hls/pkg/display"
+	"github.com/chestnutsj/hls/pkg/log"
+	"github.com/chestnutsj/hls/pkg/metalink"
+	"github.com/chestnutsj/hls/pkg/task"
+	"go.uber.org/zap"
+)
+
+// NewMetalinkTask downloads a file described by a metalink into dir. The urls are used
+// as mirrors in priority order and the file is verified against its hashes when done.
+func NewMetalinkTask(ctx context.Context, file *metalink.File, dir string, force bool, cfg *task.Config, displayOpt *display.Display) (task.Task, error) {
+	urls := make([]*url.URL, 0, len(file.URLs))
+	for _, u := range file.URLs {
+		parsed, err := url.Parse(u.URL)
+		if err != nil {
+			log.Warn("skip metalink url", zap.String("url", u.URL), zap.Error(err))
+			continue
+		}
+		urls = append(urls, parsed)
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("metalink file has no usable url")
+	}
+
+	c := *cfg
+	if file.PieceLength > 0 {
+		// keep the ranges on piece boundaries
+		pieces := c.ChunkSize / file.PieceLength
+		if pieces < 1 {
+			pieces = 1
+		}
+		c.ChunkSize = pieces * file.PieceLength
+	}
+	// the name comes from the metalink, it must stay a file inside dir
+	base := SanitizeFileName(file.Name)
+	if base == "" || base == "." || base == ".." {
+		return nil, task.Invalid("metalink", fmt.Errorf("unusable file name %q", file.Name))
+	}
+	name := filepath.Join(dir, base)
+	t := NewHttpTask(ctx, urls[0], name, force, &c, displayOpt, urls[1:]...)
+	t.(*Job).info.Checksum = &Checksum{
+		Size:        file.Size,
+		Hashes:      file.Hashes,
+		PieceType:   file.PieceType,
+		PieceLength: file.PieceLength,
+		Pieces:      file.Pieces,
+	}
+	return t, nil
+}
@@ -0,0 +1,136 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/log"
+	"github.com/chestnutsj/hls/pkg/metalink"
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_MetalinkTask(t *testing.T) {
+	err := log.DevLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(textGenerator(100000))
+	pieceLen := int64(16384)
+	var pieces []string
+	for start := int64(0); start < int64(len(data)); start += pieceLen {
+		end := min(start+pieceLen, int64(len(data)))
+		sum := sha1.Sum(data[start:end])
+		pieces = append(pieces, hex.EncodeToString(sum[:]))
+	}
+	whole := sha256.Sum256(data)
+
+	// the first answer for the second piece is corrupted, the piece has to be fetched again
+	var corrupted atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := data
+		if r.Header.Get("Range") == "bytes=16384-32767" && corrupted.CompareAndSwap(false, true) {
+			content = bytes.Repeat([]byte{'x'}, len(data))
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	file := &metalink.File{
+		Name:        "../escape/data.bin",
+		Size:        int64(len(data)),
+		Hashes:      map[string]string{"sha-256": hex.EncodeToString(whole[:])},
+		PieceType:   "sha-1",
+		PieceLength: pieceLen,
+		Pieces:      pieces,
+		URLs:        []metalink.URL{{URL: ts.URL, Priority: 1}},
+	}
+	dir := t.TempDir()
+	cfg := task.NewDownloadConfig()
+	cfg.ChunkSize = 20000
+	cfg.ThreadSize = 3
+	job, err := NewMetalinkTask(context.Background(), file, dir, true, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.(*Job).cfg.ChunkSize != pieceLen {
+		t.Fatal("chunk size not aligned to pieces", job.(*Job).cfg.ChunkSize)
+	}
+	if err = job.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !corrupted.Load() {
+		t.Fatal("corrupted piece was not served")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data not equal")
+	}
+
+	// a wrong whole file hash fails the job
+	file.Hashes["sha-256"] = hex.EncodeToString(make([]byte, 32))
+	job, err = NewMetalinkTask(context.Background(), file, dir, true, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = job.Start(); err == nil {
+		t.Fatal("want hash error")
+	}
+}
+
+func Test_MetalinkTask_Name(t *testing.T) {
+	cfg := task.NewDownloadConfig()
+	urls := []metalink.URL{{URL: "http://127.0.0.1/file"}}
+	for _, name := range []string{"", ".", "..", "../..", "a/..", " . "} {
+		_, err := NewMetalinkTask(context.Background(), &metalink.File{Name: name, URLs: urls}, t.TempDir(), false, cfg, nil)
+		var invalid *task.ValidationError
+		if !errors.As(err, &invalid) || invalid.Field != "metalink" {
+			t.Fatalf("%q: %v", name, err)
+		}
+	}
+	dir := t.TempDir()
+	job, err := NewMetalinkTask(context.Background(), &metalink.File{Name: "../up/file.bin", URLs: urls}, dir, false, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := job.(*Job).info.FileName; name != filepath.Join(dir, "file.bin") {
+		t.Fatal(name)
+	}
+}
+
+func Test_ChecksumBadPiecesUnknownSize(t *testing.T) {
+	data := []byte(textGenerator(1000))
+	var pieces []string
+	for start := 0; start < len(data); start += 400 {
+		sum := sha1.Sum(data[start:min(start+400, len(data))])
+		pieces = append(pieces, hex.EncodeToString(sum[:]))
+	}
+	broken := append([]byte(nil), data...)
+	broken[500] ^= 1
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Checksum{Size: int64(len(data)), PieceType: "sha-1", PieceLength: 400, Pieces: pieces}
+	// a stream without a length still checks the pieces by the metalink size
+	bad, err := c.BadPieces(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 1 || bad[400] != 800 {
+		t.Fatal("broken piece not found", bad)
+	}
+}
@@ -0,0 +1,157 @@
+package download
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorBackoff is how long a failing mirror is left alone, multiplied by its failures.
+const mirrorBackoff = 10 * time.Second
+
+// slowFactor demotes a mirror that is this many times slower than the fastest one.
+const slowFactor = 4
+
+type mirror struct {
+	url      string
+	speed    float64 // bytes per second, 0 is not measured yet
+	active   int
+	failures int
+	until    time.Time
+}
+
+// mirrorSet spreads range requests over the urls serving the same file.
+type mirrorSet struct {
+	mu      sync.Mutex
+	mirrors []*mirror
+	now     func() time.Time
+}
+
+func newMirrorSet(urls ...string) *mirrorSet {
+	s := &mirrorSet{now: time.Now}
+	for _, u := range urls {
+		s.add(u)
+	}
+	return s
+}
+
+func (s *mirrorSet) add(u string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.mirrors {
+		if m.url == u {
+			return
+		}
+	}
+	s.mirrors = append(s.mirrors, &mirror{url: u})
+}
+
+func (s *mirrorSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.mirrors)
+}
+
+func (s *mirrorSet) fastest() float64 {
+	best := float64(0)
+	for _, m := range s.mirrors {
+		if m.speed > best {
+			best = m.speed
+		}
+	}
+	return best
+}
+
+// pick returns the mirror with the best speed per connection. Unmeasured mirrors count
+// as the fastest so each one gets tried, failing and slow ones are used only when
+// nothing else is left.
+func (s *mirrorSet) pick() *mirror {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	best := s.fastest()
+	var chosen, fallback *mirror
+	var chosenScore float64
+	for _, m := range s.mirrors {
+		if fallback == nil || m.failures < fallback.failures {
+			fallback = m
+		}
+		if now.Before(m.until) {
+			continue
+		}
+		speed := m.speed
+		if speed == 0 {
+			speed = best + 1
+		} else if speed*slowFactor < best {
+			continue
+		}
+		score := speed / float64(m.active+1)
+		if chosen == nil || score > chosenScore {
+			chosen, chosenScore = m, score
+		}
+	}
+	if chosen == nil {
+		chosen = fallback
+	}
+	chosen.active++
+	return chosen
+}
+
+// release records how m served n bytes in d, a failure demotes it for a while.
+func (s *mirrorSet) release(m *mirror, n int64, d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.active--
+	if failed {
+		m.failures++
+		m.until = s.now().Add(time.Duration(m.failures) * mirrorBackoff)
+		return
+	}
+	m.failures = 0
+	if n > 0 && d > 0 {
+		speed := float64(n) / d.Seconds()
+		if m.speed == 0 {
+			m.speed = speed
+		} else {
+			m.speed = m.speed*0.7 + speed*0.3
+		}
+	}
+}
+
+// healthy counts the mirrors that are not backed off.
+func (s *mirrorSet) healthy() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	n := 0
+	for _, m := range s.mirrors {
+		if !now.Before(m.until) {
+			n++
+		}
+	}
+	return n
+}
+
+// parseContentRange reads the total size from "bytes 0-0/1234", -1 when it is unknown.
+func parseContentRange(v string) (int64, error) {
+	i := strings.LastIndex(v, "/")
+	if !strings.HasPrefix(v, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("invalid content range %q", v)
+	}
+	total := v[i+1:]
+	if total == "*" {
+		return -1, nil
+	}
+	return strconv.ParseInt(total, 10, 64)
+}
+
+// sameETag compares strong etags, strong is false when either one is missing or weak
+// and the etags tell nothing.
+func sameETag(a, b string) (same, strong bool) {
+	if a == "" || b == "" || strings.HasPrefix(a, "W/") || strings.HasPrefix(b, "W/") {
+		return false, false
+	}
+	return a == b, true
+}
@@ -0,0 +1,61 @@
+package download
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_mirrorSet(t *testing.T) {
+	now := time.Now()
+	s := newMirrorSet("a", "b", "a")
+	s.now = func() time.Time { return now }
+	if s.len() != 2 {
+		t.Fatal("duplicate mirror", s.len())
+	}
+
+	// unmeasured mirrors are tried first
+	a := s.pick()
+	b := s.pick()
+	if a.url == b.url {
+		t.Fatal("both connections on", a.url)
+	}
+	s.release(a, 1000, time.Second, false)
+	s.release(b, 100, time.Second, false)
+
+	// b is slower than a quarter of a and only used when a is backed off
+	for i := 0; i < 3; i++ {
+		if m := s.pick(); m.url != a.url {
+			t.Fatal("slow mirror picked")
+		}
+	}
+	fast := a
+	for i := 0; i < 3; i++ {
+		s.release(fast, 0, 0, false)
+	}
+	m := s.pick()
+	s.release(m, 0, 0, true)
+	if s.healthy() != 1 {
+		t.Fatal("failed mirror not demoted")
+	}
+	if m := s.pick(); m.url != b.url {
+		t.Fatal("should fall back to", b.url)
+	}
+	now = now.Add(mirrorBackoff)
+	if s.healthy() != 2 {
+		t.Fatal("mirror not back after backoff")
+	}
+}
+
+func Test_parseContentRange(t *testing.T) {
+	size, err := parseContentRange("bytes 0-0/1234")
+	if err != nil || size != 1234 {
+		t.Fatal(size, err)
+	}
+	size, err = parseContentRange("bytes 0-0/*")
+	if err != nil || size != -1 {
+		t.Fatal(size, err)
+	}
+	if _, err = parseContentRange("0-0/12"); err == nil {
+		t.Fatal("want error")
+	}
+}
@@ -0,0 +1,190 @@
+package download
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// NamingAuto tries the Content-Disposition, the url after redirects and then the requested url.
+	NamingAuto = "auto"
+	// NamingHeader only uses the Content-Disposition, falling back to the requested url.
+	NamingHeader = "header"
+	// NamingFinal uses the last path element of the url after redirects.
+	NamingFinal = "final"
+	// NamingURL uses the last path element of the requested url.
+	NamingURL = "url"
+)
+
+// defaultName is used when nothing better is found.
+const defaultName = "download"
+
+const maxNameLen = 255
+
+// extensions that the mime package doesn't know or guesses badly.
+var typeExtensions = map[string]string{
+	"application/vnd.apple.mpegurl": ".m3u8",
+	"application/x-mpegurl":         ".m3u8",
+	"audio/mpegurl":                 ".m3u8",
+	"video/mp2t":                    ".ts",
+	"video/mp4":                     ".mp4",
+	"video/webm":                    ".webm",
+	"video/x-matroska":              ".mkv",
+	"audio/mpeg":                    ".mp3",
+	"audio/mp4":                     ".m4a",
+	"application/zip":               ".zip",
+	"application/gzip":              ".gz",
+	"application/x-gzip":            ".gz",
+	"application/x-tar":             ".tar",
+	"application/x-7z-compressed":   ".7z",
+	"application/pdf":               ".pdf",
+	"application/json":              ".json",
+	"application/vnd.android.package-archive":       ".apk",
+	"application/x-iso9660-image":                   ".iso",
+	"application/metalink4+xml":                     ".meta4",
+	"application/x-bittorrent":                      ".torrent",
+	"text/html":                                     ".html",
+	"text/plain":                                    ".txt",
+	"application/dash+xml":                          ".mpd",
+	"application/vnd.microsoft.portable-executable": ".exe",
+}
+
+var quotedFilename = regexp.MustCompile(`(?i)filename\s*=\s*"([^"]*)"|filename\s*=\s*([^;]+)`)
+
+// FileNameFor picks the name of the file served by resp for strategy, it is always a
+// sanitised base name.
+func FileNameFor(resp *http.Response, requested *url.URL, strategy string) string {
+	var name string
+	fromURL := func(u *url.URL) string {
+		if u == nil {
+			return ""
+		}
+		return SanitizeFileName(path.Base(u.Path))
+	}
+	var final *url.URL
+	if resp != nil && resp.Request != nil {
+		final = resp.Request.URL
+	}
+	switch strategy {
+	case NamingURL:
+		name = fromURL(requested)
+	case NamingFinal:
+		name = fromURL(final)
+	case NamingHeader:
+		name = dispositionName(resp)
+	default:
+		name = dispositionName(resp)
+		if name == "" {
+			name = fromURL(final)
+		}
+	}
+	if name == "" {
+		name = fromURL(requested)
+	}
+	if name == "" {
+		name = defaultName
+	}
+	if strategy != NamingURL && filepath.Ext(name) == "" && resp != nil {
+		name += typeExtension(resp.Header.Get("Content-Type"))
+	}
+	return name
+}
+
+// dispositionName reads the filename of Content-Disposition, filename* (RFC 5987) wins.
+func dispositionName(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	v := resp.Header.Get("Content-Disposition")
+	if v == "" {
+		return ""
+	}
+	if _, params, err := mime.ParseMediaType(v); err == nil {
+		return SanitizeFileName(params["filename"])
+	}
+	// servers often send unquoted names with spaces, which the mime parser rejects
+	if m := quotedFilename.FindStringSubmatch(v); m != nil {
+		name := m[1]
+		if name == "" {
+			name = strings.TrimSpace(m[2])
+		}
+		if u, err := url.PathUnescape(name); err == nil {
+			name = u
+		}
+		return SanitizeFileName(name)
+	}
+	return ""
+}
+
+func typeExtension(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil || t == "application/octet-stream" {
+		return ""
+	}
+	if ext, ok := typeExtensions[t]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(t); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// SanitizeFileName turns a name suggested by a server into a safe base name, directories,
+// control characters and characters reserved on Windows are dropped. An unusable name
+// returns "".
+func SanitizeFileName(name string) string {
+	// keep the last element of both / and \ separated paths
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.Trim(b.String(), " .")
+	if name == "" {
+		return ""
+	}
+	if isReservedName(name) {
+		name = "_" + name
+	}
+	if len(name) > maxNameLen {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := name[:maxNameLen-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name
+}
+
+// isReservedName reports the device names Windows won't create as files.
+func isReservedName(name string) bool {
+	stem := strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	switch stem {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) {
+		return stem[3] >= '1' && stem[3] <= '9'
+	}
+	return false
+}
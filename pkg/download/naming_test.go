@@ -0,0 +1,101 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_FileNameFor(t *testing.T) {
+	requested, _ := url.Parse("http://example.com/download.php?id=1")
+	final, _ := url.Parse("http://cdn.example.com/files/movie")
+	resp := func(disposition, contentType string) *http.Response {
+		r := &http.Response{Header: http.Header{}, Request: &http.Request{URL: final}}
+		if disposition != "" {
+			r.Header.Set("Content-Disposition", disposition)
+		}
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		return r
+	}
+	cases := []struct {
+		resp     *http.Response
+		strategy string
+		want     string
+	}{
+		{resp(`attachment; filename="report.pdf"`, ""), NamingAuto, "report.pdf"},
+		{resp(`attachment; filename="a.txt"; filename*=UTF-8''%E4%B8%AD%E6%96%87.txt`, ""), NamingAuto, "中文.txt"},
+		{resp(`attachment; filename=my file.zip`, ""), NamingAuto, "my file.zip"},
+		{resp(`attachment; filename="../../etc/passwd"`, ""), NamingAuto, "passwd"},
+		{resp(`attachment; filename="..\\..\\win.ini"`, ""), NamingAuto, "win.ini"},
+		{resp("", "video/mp4"), NamingAuto, "movie.mp4"},
+		{resp("", "application/octet-stream"), NamingFinal, "movie"},
+		{resp(`attachment; filename="report.pdf"`, ""), NamingURL, "download.php"},
+		{resp(`attachment; filename="report.pdf"`, ""), NamingFinal, "movie"},
+		{resp("", ""), NamingHeader, "download.php"},
+		{resp(`attachment; filename=".."`, "text/html"), NamingHeader, "download.php"},
+	}
+	for _, c := range cases {
+		if got := FileNameFor(c.resp, requested, c.strategy); got != c.want {
+			t.Errorf("%s %q: got %q, want %q", c.strategy, c.resp.Header.Get("Content-Disposition"), got, c.want)
+		}
+	}
+}
+
+func Test_SanitizeFileName(t *testing.T) {
+	for in, want := range map[string]string{
+		"a/b/c.ts":                        "c.ts",
+		"..":                              "",
+		"con.txt":                         "_con.txt",
+		"a<b>:c?.mp4":                     "a_b__c_.mp4",
+		"x\x00y\n.bin":                    "xy.bin",
+		" .hidden. ":                      "hidden",
+		"COM1":                            "_COM1",
+		"COM10.txt":                       "COM10.txt",
+		strings.Repeat("a", 300) + ".mp4": strings.Repeat("a", 251) + ".mp4",
+	} {
+		if got := SanitizeFileName(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func Test_Job_Naming(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/get" {
+			http.Redirect(w, r, "/files/archive", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write([]byte("zip data"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir() + string(os.PathSeparator)
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.Naming = NamingAuto
+	u, _ := url.Parse(server.URL + "/get")
+	job := NewHttpTask(context.Background(), u, dir, false, cfg, nil)
+	if err := job.Start(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "archive.zip"))
+	if err != nil || string(data) != "zip data" {
+		t.Fatal(string(data), err)
+	}
+	extra, _ := job.Extra()
+	var info JobInfo
+	if err = json.Unmarshal(extra, &info); err != nil || info.FileName != filepath.Join(dir, "archive.zip") {
+		t.Fatal(info.FileName, err)
+	}
+}
@@ -0,0 +1,69 @@
+package download
+
+import (
+	"context"
+	"sync"
+)
+
+// Pauser cancels the requests in flight on Pause and holds new ones back until Resume,
+// so a paused job keeps no connection open.
+type Pauser struct {
+	mu     sync.Mutex
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	paused bool
+	resume chan struct{}
+}
+
+func NewPauser(parent context.Context) *Pauser {
+	p := &Pauser{parent: parent, resume: make(chan struct{})}
+	p.ctx, p.cancel = context.WithCancel(parent)
+	return p
+}
+
+func (p *Pauser) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return
+	}
+	p.paused = true
+	p.cancel()
+}
+
+func (p *Pauser) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	p.paused = false
+	p.ctx, p.cancel = context.WithCancel(p.parent)
+	close(p.resume)
+	p.resume = make(chan struct{})
+}
+
+func (p *Pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Wait blocks while paused and returns the context requests have to be bound to,
+// it is cancelled by the next Pause. The error is the parent's once it is done.
+func (p *Pauser) Wait() (context.Context, error) {
+	for {
+		p.mu.Lock()
+		paused, ctx, resume := p.paused, p.ctx, p.resume
+		p.mu.Unlock()
+		if !paused {
+			return ctx, p.parent.Err()
+		}
+		select {
+		case <-p.parent.Done():
+			return nil, p.parent.Err()
+		case <-resume:
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package download
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+type proxyRule struct {
+	hosts []string
+	nets  []*net.IPNet
+	proxy *url.URL
+}
+
+// WithProxy routes the requests as cfg says, an invalid proxy fails every request
+// instead of silently going direct.
+func WithProxy(cfg task.ProxyConfig) ClientOption {
+	return func(s *clientSetup) {
+		s.transport.Proxy = cfg
+	}
+}
+
+func setProxy(t *http.Transport, cfg task.ProxyConfig) {
+	proxy, err := proxyFunc(cfg)
+	if err != nil {
+		t.Proxy = func(*http.Request) (*url.URL, error) {
+			return nil, err
+		}
+		return
+	}
+	t.Proxy = proxy
+}
+
+// ValidateProxy reports the config errors WithProxy would fail the requests with.
+func ValidateProxy(cfg task.ProxyConfig) error {
+	_, err := proxyFunc(cfg)
+	if err == nil {
+		_, err = parseProxy(cfg.Key)
+	}
+	return task.Invalid("proxy", err)
+}
+
+// proxyFunc builds the Proxy of http.Transport from cfg, nil url means direct.
+func proxyFunc(cfg task.ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	if cfg.URL == "" && len(cfg.Rules) == 0 && len(cfg.NoProxy) == 0 {
+		return http.ProxyFromEnvironment, nil
+	}
+	noProxy, err := newProxyRule(cfg.NoProxy, task.ProxyDirect)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*proxyRule, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		rule, err := newProxyRule(r.Hosts, r.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	fallback := http.ProxyFromEnvironment
+	if cfg.URL != "" {
+		u, err := parseProxy(cfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		fallback = func(*http.Request) (*url.URL, error) {
+			return u, nil
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		host := req.URL.Hostname()
+		if noProxy.match(host) {
+			return nil, nil
+		}
+		for _, r := range rules {
+			if r.match(host) {
+				return r.proxy, nil
+			}
+		}
+		return fallback(req)
+	}, nil
+}
+
+func newProxyRule(hosts []string, proxy string) (*proxyRule, error) {
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	r := &proxyRule{proxy: u}
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if _, n, err := net.ParseCIDR(h); err == nil {
+			r.nets = append(r.nets, n)
+			continue
+		}
+		if h != "" {
+			r.hosts = append(r.hosts, h)
+		}
+	}
+	return r, nil
+}
+
+// parseProxy checks the proxy url, "direct" returns nil.
+func parseProxy(s string) (*url.URL, error) {
+	if s == "" || s == task.ProxyDirect {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", s, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+func (r *proxyRule) match(host string) bool {
+	host = strings.ToLower(host)
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, h := range r.hosts {
+		switch {
+		case h == "*":
+			return true
+		case strings.HasPrefix(h, "*."):
+			if strings.HasSuffix(host, h[1:]) {
+				return true
+			}
+		case strings.HasPrefix(h, "."):
+			if strings.HasSuffix(host, h) {
+				return true
+			}
+		default:
+			if host == h || strings.HasSuffix(host, "."+h) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package download
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// socks5Server accepts user u password p and counts the connections it relays.
+func socks5Server(t *testing.T) (string, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var count atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				relay(conn, &count)
+			}()
+		}
+	}()
+	return ln.Addr().String(), &count
+}
+
+func relay(conn net.Conn, count *atomic.Int32) {
+	buf := make([]byte, 512)
+	// greeting: version, methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+	// user/password sub negotiation
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(conn, pass)
+	if string(user) != "u" || string(pass) != "p" {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+	// connect request
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(conn, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	count.Add(1)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func proxyClient(t *testing.T, cfg task.ProxyConfig) MyClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewClient(ctx, 0, time.Second, time.Second, WithProxy(cfg))
+}
+
+func Test_proxySocks5(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	addr, count := socks5Server(t)
+
+	client := proxyClient(t, task.ProxyConfig{URL: "socks5://u:p@" + addr})
+	if resp := get(t, client, server.URL); resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	if count.Load() != 1 {
+		t.Fatal("request did not go through the proxy")
+	}
+}
+
+func Test_proxyRules(t *testing.T) {
+	var proxied atomic.Int32
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") == "" || !r.URL.IsAbs() {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		proxied.Add(1)
+	}))
+	defer httpProxy.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(httpProxy.URL)
+	proxyURL.User = url.UserPassword("u", "p")
+	cfg := task.ProxyConfig{
+		URL:     task.ProxyDirect,
+		Rules:   []task.ProxyRule{{Hosts: []string{"127.0.0.0/8"}, Proxy: proxyURL.String()}},
+		NoProxy: []string{"localhost"},
+	}
+	if resp := get(t, proxyClient(t, cfg), server.URL); resp.StatusCode != http.StatusOK || proxied.Load() != 1 {
+		t.Fatal("rule not applied", resp.Status, proxied.Load())
+	}
+
+	// no_proxy wins over the rules
+	cfg.NoProxy = []string{"127.0.0.1"}
+	if resp := get(t, proxyClient(t, cfg), server.URL); resp.StatusCode != http.StatusOK || proxied.Load() != 1 {
+		t.Fatal("no_proxy ignored", resp.Status, proxied.Load())
+	}
+
+	// the keys go direct while the rest uses the proxy
+	cfg = task.ProxyConfig{URL: proxyURL.String(), Key: task.ProxyDirect}
+	if resp := get(t, proxyClient(t, cfg.ForKeys()), server.URL); resp.StatusCode != http.StatusOK || proxied.Load() != 1 {
+		t.Fatal("key request proxied", resp.Status, proxied.Load())
+	}
+	if resp := get(t, proxyClient(t, cfg), server.URL); resp.StatusCode != http.StatusOK || proxied.Load() != 2 {
+		t.Fatal("segment request not proxied", resp.Status, proxied.Load())
+	}
+}
+
+func Test_proxyRuleMatch(t *testing.T) {
+	r, err := newProxyRule([]string{"example.com", "*.cdn.net", ".video.org", "10.0.0.0/8"}, task.ProxyDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{
+		"example.com":     true,
+		"a.example.com":   true,
+		"badexample.com":  false,
+		"x.cdn.net":       true,
+		"cdn.net":         false,
+		"a.video.org":     true,
+		"10.1.2.3":        true,
+		"11.1.2.3":        false,
+		"EXAMPLE.COM":     true,
+		"example.com.org": false,
+	} {
+		if r.match(host) != want {
+			t.Error(host, "want", want)
+		}
+	}
+	if err = ValidateProxy(task.ProxyConfig{URL: "ftp://proxy"}); err == nil {
+		t.Fatal("want scheme error")
+	}
+	if err = ValidateProxy(task.ProxyConfig{Key: "socks5://"}); err == nil {
+		t.Fatal("want host error")
+	}
+}
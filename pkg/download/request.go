@@ -0,0 +1,200 @@
+package download
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// RequestVars are the fields of the request templates.
+type RequestVars struct {
+	// URL is the url of the request before Query is applied, Path is unescaped
+	URL    string
+	Scheme string
+	Host   string
+	Path   string
+	Query  string
+	// Index is the position of the segment in its playlist, Sequence its media sequence
+	// number, both are 0 for a plain download
+	Index    int
+	Sequence int64
+	// Timestamp and TimestampMs are the unix time of the request
+	Timestamp   int64
+	TimestampMs int64
+}
+
+// Signer changes a request right before it is sent, it runs again for every retry.
+type Signer func(req *http.Request) error
+
+var (
+	signerLock sync.RWMutex
+	signers    = map[string]Signer{}
+)
+
+// RegisterSigner makes s the hook of RequestConfig.Signer name.
+func RegisterSigner(name string, s Signer) {
+	signerLock.Lock()
+	defer signerLock.Unlock()
+	signers[name] = s
+}
+
+// templateFuncs are the helpers of the request templates, e.g.
+// {{hmacSHA256 (env "SIGN_KEY") .Path}}.
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+	"hmacSHA256": func(key, data string) string {
+		return hex.EncodeToString(hmacSHA256([]byte(key), data))
+	},
+	"sha256": func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	},
+	"md5": func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return hex.EncodeToString(sum[:])
+	},
+	"base64": func(data string) string {
+		return base64.StdEncoding.EncodeToString([]byte(data))
+	},
+}
+
+// requestTemplate is a parsed RequestConfig.
+type requestTemplate struct {
+	method      string
+	body        *template.Template
+	contentType string
+	headers     map[string]*template.Template
+	query       map[string]*template.Template
+	signer      Signer
+}
+
+// ValidateRequest reports templates that do not parse and unknown signers.
+func ValidateRequest(cfg task.RequestConfig) error {
+	_, err := newRequestTemplate(cfg)
+	return task.Invalid("request", err)
+}
+
+// newRequestTemplate parses cfg, nil when it changes nothing.
+func newRequestTemplate(cfg task.RequestConfig) (*requestTemplate, error) {
+	if cfg.Method == "" && cfg.Body == "" && len(cfg.Headers) == 0 && len(cfg.Query) == 0 && cfg.Signer == "" {
+		return nil, nil
+	}
+	r := &requestTemplate{
+		method:      strings.ToUpper(cfg.Method),
+		contentType: cfg.ContentType,
+		headers:     make(map[string]*template.Template),
+		query:       make(map[string]*template.Template),
+	}
+	if r.method == "" {
+		r.method = http.MethodGet
+	}
+	parse := func(name, text string) (*template.Template, error) {
+		t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("request template %s: %w", name, err)
+		}
+		return t, nil
+	}
+	var err error
+	if cfg.Body != "" {
+		if r.body, err = parse("body", cfg.Body); err != nil {
+			return nil, err
+		}
+		if r.contentType == "" {
+			r.contentType = "application/x-www-form-urlencoded"
+			if t := strings.TrimSpace(cfg.Body); strings.HasPrefix(t, "{") || strings.HasPrefix(t, "[") {
+				r.contentType = "application/json"
+			}
+		}
+	}
+	for k, v := range cfg.Headers {
+		if r.headers[k], err = parse("header "+k, v); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range cfg.Query {
+		if r.query[k], err = parse("query "+k, v); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Signer != "" {
+		signerLock.RLock()
+		r.signer = signers[cfg.Signer]
+		signerLock.RUnlock()
+		if r.signer == nil {
+			return nil, fmt.Errorf("unknown request signer %q", cfg.Signer)
+		}
+	}
+	return r, nil
+}
+
+func render(t *template.Template, vars *RequestVars) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// newRequest builds the request of rawURL from the template, the url fields of vars are filled.
+func (r *requestTemplate) newRequest(rawURL string, vars *RequestVars) (*http.Request, error) {
+	req, err := http.NewRequest(r.method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	vars.URL = rawURL
+	vars.Scheme = req.URL.Scheme
+	vars.Host = req.URL.Host
+	vars.Path = req.URL.Path
+	vars.Query = req.URL.RawQuery
+	vars.Timestamp = now.Unix()
+	vars.TimestampMs = now.UnixMilli()
+
+	if len(r.query) > 0 {
+		q := req.URL.Query()
+		for k, t := range r.query {
+			v, err := render(t, vars)
+			if err != nil {
+				return nil, err
+			}
+			q.Set(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	if r.body != nil {
+		body, err := render(r.body, vars)
+		if err != nil {
+			return nil, err
+		}
+		// a reader of http.NewRequest lets retries and redirects send it again
+		if req, err = http.NewRequest(r.method, req.URL.String(), strings.NewReader(body)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", r.contentType)
+	}
+	return req, nil
+}
+
+// setHeaders renders the header templates over the headers of req.
+func (r *requestTemplate) setHeaders(req *http.Request, vars *RequestVars) error {
+	for k, t := range r.headers {
+		v, err := render(t, vars)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(k, v)
+	}
+	return nil
+}
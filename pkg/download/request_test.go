@@ -0,0 +1,82 @@
+package download
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_Job_RequestTemplate(t *testing.T) {
+	data := []byte(textGenerator(300000))
+	var signed, ranged atomic.Int32
+	RegisterSigner("test", func(req *http.Request) error {
+		req.Header.Set("X-Signature", "signed "+req.URL.Query().Get("sign"))
+		signed.Add(1)
+		return nil
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sign := hex.EncodeToString(hmacSHA256([]byte("key"), r.URL.Path))
+		switch {
+		case r.Method != http.MethodPost:
+			http.Error(w, "method", http.StatusMethodNotAllowed)
+		case string(body) != `{"path":"/files/movie.ts","index":0}` || r.Header.Get("Content-Type") != "application/json":
+			http.Error(w, "body "+string(body), http.StatusBadRequest)
+		case r.URL.Query().Get("sign") != sign || r.URL.Query().Get("id") != "1":
+			http.Error(w, "query "+r.URL.RawQuery, http.StatusForbidden)
+		case r.Header.Get("X-Signature") != "signed "+sign:
+			http.Error(w, "signer "+r.Header.Get("X-Signature"), http.StatusForbidden)
+		case r.Header.Get("Referer") != "https://site.example/play/0" || r.Header.Get("Origin") != "https://site.example":
+			http.Error(w, "referer "+r.Header.Get("Referer"), http.StatusForbidden)
+		default:
+			if r.Header.Get("Range") != "" {
+				ranged.Add(1)
+			}
+			http.ServeContent(w, r, "movie.ts", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	defer server.Close()
+
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.ChunkSize = 50000
+	cfg.ThreadSize = 4
+	cfg.Headers = map[string]string{"Origin": "https://site.example", "Referer": "https://other.example"}
+	cfg.Request = task.RequestConfig{
+		Method:  "post",
+		Body:    `{"path":"{{.Path}}","index":{{.Index}}}`,
+		Headers: map[string]string{"Referer": "https://site.example/play/{{.Index}}"},
+		Query:   map[string]string{"sign": `{{hmacSHA256 "key" .Path}}`},
+		Signer:  "test",
+	}
+	checkDownload(t, server.URL+"/files/movie.ts?id=1", cfg, "movie.ts", data)
+	if ranged.Load() == 0 || signed.Load() == 0 {
+		t.Fatal("ranges", ranged.Load(), "signed", signed.Load())
+	}
+}
+
+func Test_ValidateRequest(t *testing.T) {
+	for _, c := range []struct {
+		cfg task.RequestConfig
+		err string
+	}{
+		{task.RequestConfig{}, ""},
+		{task.RequestConfig{Headers: map[string]string{"X-Time": "{{.Timestamp}}"}}, ""},
+		{task.RequestConfig{Body: "a={{.Index"}, "body"},
+		{task.RequestConfig{Query: map[string]string{"s": "{{nope .Path}}"}}, "query s"},
+		{task.RequestConfig{Signer: "missing"}, "signer"},
+	} {
+		err := ValidateRequest(c.cfg)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%+v: %v", c.cfg, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package download
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// emptySHA256 is the payload hash of a request without body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Source reads s3://bucket/key urls with signed ranged GETs.
+type s3Source struct {
+	client MyClient
+	cfg    task.S3Config
+	// object is the url of the key on the endpoint
+	object *url.URL
+	key    string
+	now    func() time.Time
+}
+
+func newS3Source(ctx context.Context, u *url.URL, cfg *task.Config) (Source, error) {
+	if cfg == nil {
+		cfg = &task.Config{}
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("s3 url %s needs a bucket and a key", u.Redacted())
+	}
+	s3 := cfg.S3
+	if s3.Region == "" {
+		s3.Region = "us-east-1"
+	}
+	endpoint := s3.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+	}
+	object, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	if object.Scheme == "" || object.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %q needs a scheme and a host", endpoint)
+	}
+	prefix := strings.TrimSuffix(object.Path, "/")
+	if s3.PathStyle {
+		prefix += "/" + bucket
+	} else {
+		object.Host = bucket + "." + object.Host
+	}
+	object.Path = prefix + "/" + key
+	object.RawPath = awsEscapePath(object.Path)
+
+	s := &s3Source{cfg: s3, object: object, key: key, now: time.Now}
+	s.client = NewClient(ctx, int(cfg.RetryCount), time.Duration(cfg.ConnTimeout)*time.Second,
+		time.Duration(cfg.ConnTimeout)*time.Second, WithProxy(cfg.Proxy), WithTLS(cfg.TLS), WithNetwork(cfg.Network),
+		WithSigner(s.sign))
+	return s, nil
+}
+
+// sign runs for every attempt, a retry after a long backoff gets a fresh date.
+func (s *s3Source) sign(req *http.Request) error {
+	if s.cfg.AccessKey != "" {
+		signV4(req, s.cfg, s.now())
+	}
+	return nil
+}
+
+// Close stops the retries of the client.
+func (s *s3Source) Close() error {
+	s.client.Cancel()
+	return nil
+}
+
+func (s *s3Source) do(ctx context.Context, method, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.object.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, &StatusError{URL: s.object.Redacted(), Code: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+func (s *s3Source) Stat(ctx context.Context) (SourceInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, "")
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	_ = resp.Body.Close()
+	size := resp.ContentLength
+	if size < 0 {
+		size = -1
+	}
+	return SourceInfo{Size: size, Ranges: true, Tag: resp.Header.Get("ETag"), Name: path.Base(s.key)}, nil
+}
+
+func (s *s3Source) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	var byteRange string
+	if length > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	} else if offset > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-", offset)
+	}
+	resp, err := s.do(ctx, http.MethodGet, byteRange)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" && resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, errors.New("s3 endpoint ignored range request")
+	}
+	return resp.Body, nil
+}
+
+// signV4 adds the AWS signature version 4 of req, the host, the range and the
+// x-amz-* headers are signed.
+func signV4(req *http.Request, cfg task.S3Config, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cfg.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL),
+		canonical.String(),
+		signed,
+		emptySHA256,
+	}, "\n")
+	scope := day + "/" + cfg.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), day)
+	for _, part := range []string{cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery sorts the query by name and value, encoded the way AWS expects.
+func canonicalQuery(u *url.URL) string {
+	var pairs []string
+	for k, values := range u.Query() {
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func awsEscapePath(p string) string {
+	return awsEscape(p, false)
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, and '/' unless
+// slash is set.
+func awsEscape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package download
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// minSplitSize is the smallest range an idle connection will steal from a running one.
+const minSplitSize = 256 * 1024
+
+// segment is the byte range [start, end) fetched by one connection.
+// pos is the next byte to fetch, end shrinks when an idle connection steals the tail.
+type segment struct {
+	mu    sync.Mutex
+	start int64
+	pos   int64
+	end   int64
+}
+
+func newSegment(start, end int64) *segment {
+	return &segment{start: start, pos: start, end: end}
+}
+
+// bounds returns the part that still has to be fetched.
+func (s *segment) bounds() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pos, s.end
+}
+
+func (s *segment) remaining() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end - s.pos
+}
+
+// clip returns how many of the n bytes at offset belong to the segment.
+// An end of 0 means the length is unknown.
+func (s *segment) clip(offset int64, n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end > 0 {
+		if offset >= s.end {
+			return 0
+		}
+		if offset+int64(n) > s.end {
+			n = int(s.end - offset)
+		}
+	}
+	return n
+}
+
+// commit marks everything before pos as handed to the writer.
+func (s *segment) commit(pos int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos > s.pos {
+		s.pos = pos
+	}
+}
+
+// advance clips n bytes at offset and commits them.
+func (s *segment) advance(offset int64, n int) int {
+	n = s.clip(offset, n)
+	s.commit(offset + int64(n))
+	return n
+}
+
+func (s *segment) finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end > 0 && s.pos >= s.end
+}
+
+// split hands the second half of the remaining bytes to a new segment, with align the
+// tail starts on a multiple of it.
+func (s *segment) split(minSize, align int64) *segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	left := s.end - s.pos
+	if left < 2*minSize {
+		return nil
+	}
+	mid := s.pos + left/2
+	if align > 0 {
+		mid -= mid % align
+		if mid <= s.pos {
+			mid += align
+		}
+		if mid >= s.end {
+			return nil
+		}
+	}
+	tail := newSegment(mid, s.end)
+	s.end = mid
+	return tail
+}
+
+// scheduler hands out ranges to a fixed pool of connections.
+type scheduler struct {
+	mu       sync.Mutex
+	pending  []*segment
+	running  map[*segment]struct{}
+	minSplit int64
+	// align keeps the splits on piece boundaries, 0 splits anywhere
+	align int64
+	// changed is closed and replaced when a range is released
+	changed chan struct{}
+}
+
+func newScheduler(ranges map[int64]int64, minSplit int64) *scheduler {
+	s := &scheduler{
+		pending:  make([]*segment, 0, len(ranges)),
+		running:  make(map[*segment]struct{}),
+		minSplit: minSplit,
+		changed:  make(chan struct{}),
+	}
+	for start, end := range ranges {
+		s.pending = append(s.pending, newSegment(start, end))
+	}
+	sort.Slice(s.pending, func(i, j int) bool {
+		return s.pending[i].start < s.pending[j].start
+	})
+	return s
+}
+
+// next returns the next pending range, or splits the largest running one.
+// nil means there is nothing left worth fetching.
+func (s *scheduler) next() *segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextLocked()
+}
+
+func (s *scheduler) nextLocked() *segment {
+	if len(s.pending) > 0 {
+		seg := s.pending[0]
+		s.pending = s.pending[1:]
+		s.running[seg] = struct{}{}
+		return seg
+	}
+	var largest *segment
+	var size int64
+	for seg := range s.running {
+		if l := seg.remaining(); l > size {
+			largest, size = seg, l
+		}
+	}
+	if largest == nil {
+		return nil
+	}
+	tail := largest.split(s.minSplit, s.align)
+	if tail != nil {
+		s.running[tail] = struct{}{}
+	}
+	return tail
+}
+
+// wait is next for an idle connection, it waits for a requeued range or a split while
+// others are still running. nil means everything is done or ctx is cancelled.
+func (s *scheduler) wait(ctx context.Context) *segment {
+	for {
+		s.mu.Lock()
+		seg := s.nextLocked()
+		idle := len(s.pending)+len(s.running) == 0
+		changed := s.changed
+		s.mu.Unlock()
+		if seg != nil || idle {
+			return seg
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// done releases seg, an unfinished segment goes back to the queue.
+func (s *scheduler) done(seg *segment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, seg)
+	if !seg.finished() {
+		pos, end := seg.bounds()
+		s.pending = append(s.pending, &segment{start: seg.start, pos: pos, end: end})
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *scheduler) left() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending) + len(s.running)
+}
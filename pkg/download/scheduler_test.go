@@ -0,0 +1,114 @@
+package download
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_scheduler(t *testing.T) {
+	sched := newScheduler(map[int64]int64{0: 100, 100: 200}, 10)
+
+	first := sched.next()
+	second := sched.next()
+	if first.start != 0 || second.start != 100 {
+		t.Fatal("pending ranges are not in order", first.start, second.start)
+	}
+	first.advance(0, 100)
+	sched.done(first)
+
+	// the idle connection steals the second half of the running range
+	second.advance(100, 20)
+	tail := sched.next()
+	if tail == nil {
+		t.Fatal("expect a split")
+	}
+	if pos, end := second.bounds(); pos != 120 || end != 160 {
+		t.Fatal("wrong head", pos, end)
+	}
+	if pos, end := tail.bounds(); pos != 160 || end != 200 {
+		t.Fatal("wrong tail", pos, end)
+	}
+
+	// bytes after the new end belong to the tail
+	if n := second.advance(150, 30); n != 10 {
+		t.Fatal("advance should stop at the split point", n)
+	}
+	if !second.finished() {
+		t.Fatal("head should be finished")
+	}
+	sched.done(second)
+
+	// an unfinished range goes back to the queue and keeps its status key
+	tail.advance(160, 5)
+	sched.done(tail)
+	again := sched.next()
+	if pos, end := again.bounds(); again.start != 160 || pos != 165 || end != 200 {
+		t.Fatal("wrong requeue", again.start, pos, end)
+	}
+	again.advance(165, 35)
+	sched.done(again)
+	if sched.next() != nil || sched.left() != 0 {
+		t.Fatal("nothing should be left")
+	}
+}
+
+func Test_schedulerWait(t *testing.T) {
+	// too small to split, an idle connection has to wait for it
+	sched := newScheduler(map[int64]int64{0: 100}, 100)
+	seg := sched.next()
+	got := make(chan *segment)
+	go func() {
+		got <- sched.wait(context.Background())
+	}()
+	select {
+	case <-got:
+		t.Fatal("idle connection should wait while the range runs")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// a failed fetch gives the range back, the waiting connection takes it over
+	seg.advance(0, 40)
+	sched.done(seg)
+	again := <-got
+	if again == nil || again.start != 0 {
+		t.Fatal("requeued range not handed to the waiting connection")
+	}
+	if pos, end := again.bounds(); pos != 40 || end != 100 {
+		t.Fatal("wrong requeue", pos, end)
+	}
+
+	go func() {
+		got <- sched.wait(context.Background())
+	}()
+	again.advance(40, 60)
+	sched.done(again)
+	if <-got != nil {
+		t.Fatal("nothing should be left")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	busy := newScheduler(map[int64]int64{0: 100}, 100)
+	busy.next()
+	cancel()
+	if busy.wait(ctx) != nil {
+		t.Fatal("cancelled wait should return nil")
+	}
+}
+
+func Test_segmentSplitAlign(t *testing.T) {
+	seg := newSegment(0, 1000)
+	seg.advance(0, 130)
+	tail := seg.split(10, 64)
+	if tail == nil || tail.start%64 != 0 {
+		t.Fatal("tail not on a piece boundary", tail)
+	}
+	if _, end := seg.bounds(); end != tail.start {
+		t.Fatal("head does not end where the tail starts", end, tail.start)
+	}
+	// no boundary left in the remaining bytes
+	small := newSegment(0, 100)
+	small.advance(0, 10)
+	if small.split(10, 128) != nil {
+		t.Fatal("split inside a piece")
+	}
+}
@@ -0,0 +1,205 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSource reads sftp:// urls, ranges are read with ReadAt. The threads share one
+// ssh connection, it is closed with the source.
+type sftpSource struct {
+	addr    string
+	path    string
+	config  *ssh.ClientConfig
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPSource(_ context.Context, u *url.URL, cfg *task.Config) (Source, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("sftp url %s has no host", u.Redacted())
+	}
+	if cfg == nil {
+		cfg = &task.Config{}
+	}
+	s := &sftpSource{addr: hostPort(u, "22"), path: u.Path, timeout: 30 * time.Second}
+	if strings.HasPrefix(s.path, "/~/") {
+		// relative to the home directory like curl
+		s.path = strings.TrimPrefix(s.path, "/~/")
+	}
+	if cfg.ConnTimeout > 0 {
+		s.timeout = time.Duration(cfg.ConnTimeout) * time.Second
+	}
+	user, password := urlCredentials(u, cfg)
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	var methods []ssh.AuthMethod
+	signers, err := sshSigners(cfg.SSH)
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	hostKey, err := sshHostKeys(cfg.SSH)
+	if err != nil {
+		return nil, err
+	}
+	s.config = &ssh.ClientConfig{User: user, Auth: methods, HostKeyCallback: hostKey, Timeout: s.timeout}
+	return s, nil
+}
+
+// sshSigners loads KeyFile, or the default keys that exist.
+func sshSigners(cfg task.SSHConfig) ([]ssh.Signer, error) {
+	files := []string{cfg.KeyFile}
+	if cfg.KeyFile == "" {
+		home, _ := os.UserHomeDir()
+		files = []string{filepath.Join(home, ".ssh", "id_ed25519"), filepath.Join(home, ".ssh", "id_rsa")}
+	}
+	var signers []ssh.Signer
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			if cfg.KeyFile == "" && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			if cfg.KeyFile == "" {
+				// a default key behind a passphrase is left out
+				continue
+			}
+			return nil, fmt.Errorf("ssh key %s: %w", name, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// sshHostKeys checks the server keys against the known hosts file, unknown hosts are refused.
+func sshHostKeys(cfg task.SSHConfig) (ssh.HostKeyCallback, error) {
+	name := cfg.KnownHosts
+	if name == "" {
+		home, _ := os.UserHomeDir()
+		name = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(name)
+	if err != nil {
+		return nil, fmt.Errorf("ssh known hosts: %w", err)
+	}
+	return callback, nil
+}
+
+func (s *sftpSource) connect(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	d := net.Dialer{Timeout: s.timeout}
+	nc, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, &NetworkError{URL: "sftp://" + s.addr, Err: err}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(nc, s.addr, s.config)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	s.conn = ssh.NewClient(c, chans, reqs)
+	if s.client, err = sftp.NewClient(s.conn); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return nil, err
+	}
+	return s.client, nil
+}
+
+func (s *sftpSource) Stat(ctx context.Context) (SourceInfo, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	info, err := client.Stat(s.path)
+	if err != nil {
+		return SourceInfo{}, fmt.Errorf("sftp stat %s: %w", s.path, err)
+	}
+	if info.IsDir() {
+		return SourceInfo{}, fmt.Errorf("%s is a directory", s.path)
+	}
+	return SourceInfo{
+		Size:   info.Size(),
+		Ranges: true,
+		Tag:    fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+		Name:   path.Base(s.path),
+	}, nil
+}
+
+func (s *sftpSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("sftp open %s: %w", s.path, err)
+	}
+	if length <= 0 {
+		length = math.MaxInt64 - offset
+	}
+	body := &sftpBody{Reader: io.NewSectionReader(file, offset, length), file: file}
+	// a blocked read returns once the request is cancelled
+	body.stop = context.AfterFunc(ctx, func() { _ = file.Close() })
+	return body, nil
+}
+
+// Close ends the ssh connection.
+func (s *sftpSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	_ = s.client.Close()
+	err := s.conn.Close()
+	s.client, s.conn = nil, nil
+	return err
+}
+
+type sftpBody struct {
+	io.Reader
+	file *sftp.File
+	stop func() bool
+}
+
+func (b *sftpBody) Close() error {
+	if !b.stop() {
+		return nil
+	}
+	return b.file.Close()
+}
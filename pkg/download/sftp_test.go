@@ -0,0 +1,126 @@
+package download
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chestnutsj/hls/pkg/task"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpServer serves the local file system to user test with password secret, it
+// returns the address and a known hosts file holding its key.
+func sftpServer(t *testing.T) (string, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "test" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{ln.Addr().String()}, signer.PublicKey())
+	if err = os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ln.Addr().String(), knownHosts
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					go func() {
+						server, err := sftp.NewServer(ch, sftp.ReadOnly())
+						if err == nil {
+							_ = server.Serve()
+						}
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func Test_Job_SFTP(t *testing.T) {
+	data := []byte(textGenerator(300000))
+	file := filepath.Join(t.TempDir(), "movie.ts")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr, knownHosts := sftpServer(t)
+
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.ChunkSize = 50000
+	cfg.ThreadSize = 4
+	cfg.SSH.KnownHosts = knownHosts
+	rawURL := "sftp://test:secret@" + addr + filepath.ToSlash(file)
+	checkDownload(t, rawURL, cfg, "movie.ts", data)
+
+	// a host missing from known hosts is refused
+	cfg.SSH.KnownHosts = filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(cfg.SSH.KnownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewSource(context.Background(), rawURL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSource(src)
+	if _, err = src.Stat(context.Background()); err == nil {
+		t.Fatal("unknown host key accepted")
+	}
+}
@@ -0,0 +1,211 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// SourceInfo is what a source tells about its file before the download.
+type SourceInfo struct {
+	// Size is -1 when unknown
+	Size int64
+	// Ranges reports whether Open honours an offset and a length
+	Ranges bool
+	// Tag changes when the content changes, like an ETag
+	Tag string
+	// Name is the suggested file name
+	Name string
+}
+
+// Source reads the file of a url for the job and the transfer, MyClient is the one of
+// http and https. A source that is an io.Closer is closed when the job ends.
+type Source interface {
+	Stat(ctx context.Context) (SourceInfo, error)
+	// Open reads length bytes from offset, a length of 0 reads to the end.
+	Open(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+}
+
+// SourceFactory makes the source of u, a source holding a client stops it when ctx is done.
+type SourceFactory func(ctx context.Context, u *url.URL, cfg *task.Config) (Source, error)
+
+var (
+	sourceLock sync.RWMutex
+	sources    = map[string]SourceFactory{
+		"file": newFileSource,
+		"data": newDataSource,
+		"ftp":  newFTPSource,
+		"sftp": newSFTPSource,
+		"s3":   newS3Source,
+	}
+)
+
+// RegisterSource makes NewSource use f for the urls of scheme.
+func RegisterSource(scheme string, f SourceFactory) {
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+	sources[strings.ToLower(scheme)] = f
+}
+
+// NewSource returns the source of rawURL, nil when it is read with MyClient. A url
+// without scheme or with a drive letter is a local path.
+func NewSource(ctx context.Context, rawURL string, cfg *task.Config) (Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		if filepath.IsAbs(rawURL) {
+			return &fileSource{path: rawURL}, nil
+		}
+		return nil, err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if len(scheme) == 1 {
+		return &fileSource{path: rawURL}, nil
+	}
+	if scheme == "" {
+		// the job keeps the url escaped
+		name := u.Path
+		if u.RawQuery != "" || u.ForceQuery {
+			name += "?" + u.RawQuery
+		}
+		return &fileSource{path: filepath.FromSlash(name)}, nil
+	}
+	if scheme == "http" || scheme == "https" {
+		return nil, nil
+	}
+	sourceLock.RLock()
+	f, ok := sources[scheme]
+	sourceLock.RUnlock()
+	if !ok {
+		return nil, task.Invalid("url", fmt.Errorf("unsupported scheme %q", u.Scheme))
+	}
+	return f(ctx, u, cfg)
+}
+
+func closeSource(src Source) {
+	if c, ok := src.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// fileSource reads a local file, also on NFS or other mounted storage.
+type fileSource struct {
+	path string
+}
+
+func newFileSource(_ context.Context, u *url.URL, _ *task.Config) (Source, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file url %s has a remote host", u.Redacted())
+	}
+	return &fileSource{path: filepath.FromSlash(u.Path)}, nil
+}
+
+func (s *fileSource) Stat(context.Context) (SourceInfo, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	if info.IsDir() {
+		return SourceInfo{}, fmt.Errorf("%s is a directory", s.path)
+	}
+	return SourceInfo{
+		Size:   info.Size(),
+		Ranges: true,
+		Tag:    fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+		Name:   filepath.Base(s.path),
+	}, nil
+}
+
+func (s *fileSource) Open(_ context.Context, offset, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if length <= 0 {
+		return file, nil
+	}
+	return &limitedFile{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// dataSource serves the content of a data: url (RFC 2397).
+type dataSource struct {
+	data      []byte
+	mediaType string
+}
+
+func newDataSource(_ context.Context, u *url.URL, _ *task.Config) (Source, error) {
+	opaque := u.Opaque
+	// the parser takes ? and # for url parts
+	if u.RawQuery != "" || u.ForceQuery {
+		opaque += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		opaque += "#" + u.EscapedFragment()
+	}
+	meta, payload, ok := strings.Cut(opaque, ",")
+	if !ok {
+		return nil, errors.New("data url without ','")
+	}
+	s := &dataSource{mediaType: "text/plain"}
+	isBase64 := false
+	if strings.HasSuffix(meta, ";base64") {
+		isBase64 = true
+		meta = strings.TrimSuffix(meta, ";base64")
+	}
+	if meta != "" {
+		s.mediaType = meta
+	}
+	text, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, err
+	}
+	if isBase64 {
+		if s.data, err = base64.StdEncoding.DecodeString(text); err != nil {
+			if s.data, err = base64.RawStdEncoding.DecodeString(text); err != nil {
+				return nil, fmt.Errorf("data url: %w", err)
+			}
+		}
+	} else {
+		s.data = []byte(text)
+	}
+	return s, nil
+}
+
+func (s *dataSource) Stat(context.Context) (SourceInfo, error) {
+	name := defaultName
+	if t, _, err := mime.ParseMediaType(s.mediaType); err == nil {
+		name += typeExtension(t)
+	}
+	return SourceInfo{Size: int64(len(s.data)), Ranges: true, Name: name}, nil
+}
+
+func (s *dataSource) Open(_ context.Context, offset, length int64) (io.ReadCloser, error) {
+	size := int64(len(s.data))
+	if offset > size {
+		return nil, fmt.Errorf("offset %d beyond %d bytes", offset, size)
+	}
+	end := size
+	if length > 0 && offset+length < size {
+		end = offset + length
+	}
+	return io.NopCloser(bytes.NewReader(s.data[offset:end])), nil
+}
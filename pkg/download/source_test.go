@@ -0,0 +1,94 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_Job_LocalSources(t *testing.T) {
+	data := []byte(textGenerator(300000))
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src dir", "movie.ts")
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	small := []byte("hello, data url")
+
+	cfg := task.NewDownloadConfig()
+	cfg.ChunkSize = 50000
+	cfg.ThreadSize = 4
+	for _, c := range []struct {
+		name string
+		url  string
+		want []byte
+		file string
+	}{
+		{"path", src, data, "movie.ts"},
+		{"file url", (&url.URL{Scheme: "file", Path: filepath.ToSlash(src)}).String(), data, "movie.ts"},
+		{"data base64", "data:text/plain;base64," + base64.StdEncoding.EncodeToString(small), small, "download.txt"},
+		{"data plain", "data:,hello%2C%20data%20url", small, "download.txt"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			checkDownload(t, c.url, cfg, c.file, c.want)
+		})
+	}
+
+	// copying a file onto itself leaves it alone
+	u, _ := url.Parse(src)
+	if err := NewHttpTask(context.Background(), u, src, true, cfg, nil).Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+		t.Fatal("source changed")
+	}
+}
+
+// checkDownload runs a job for rawURL into a new dir and compares the file named name.
+func checkDownload(t *testing.T, rawURL string, cfg *task.Config, name string, want []byte) {
+	t.Helper()
+	out := t.TempDir() + string(os.PathSeparator)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = NewHttpTask(context.Background(), u, out, false, cfg, nil).Start(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("content differs", len(got), len(want))
+	}
+}
+
+func Test_dataSourceRange(t *testing.T) {
+	u, _ := url.Parse("data:,0123456789")
+	src, err := newDataSource(context.Background(), u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := src.Open(context.Background(), 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(r)
+	if buf.String() != "3456" {
+		t.Fatal(buf.String())
+	}
+	if _, err = NewSource(context.Background(), "gopher://example.com/x", nil); err == nil {
+		t.Fatal("want unsupported scheme")
+	}
+}
@@ -3,6 +3,7 @@ package download
 import (
 	"bytes"
 	"encoding/binary"
+	"sync/atomic"
 	"time"
 
 	"github.com/chestnutsj/hls/pkg/display"
@@ -16,6 +17,10 @@ type Progress struct {
 	cache *store.BitCask
 	bar   *mpb.Bar
 	curr  time.Time
+	// dynamic grows the total of the bar while the size is unknown
+	dynamic bool
+	// done counts the bytes in the file, the ones of a previous run included
+	done atomic.Int64
 }
 
 func NewProgress(bar *mpb.Bar) *Progress {
@@ -31,7 +36,7 @@ func (p *Progress) InitCache(path, ext string, metadata []byte) error {
 	statusDb, err := store.NewBitCask(path)
 	if err != nil {
 		zap.L().Error("init status cache failed", zap.Error(err))
-		return err
+		return &DiskError{Op: "open status", Path: path, Err: err}
 	}
 	if statusDb.Len() != 0 {
 		cache, err := statusDb.Get("status")
@@ -55,41 +60,79 @@ func (p *Progress) InitCache(path, ext string, metadata []byte) error {
 	return statusDb.Set("status", metadata)
 }
 
+// GetTasks returns the ranges [start, end) that are not on disk yet, at most chunkSize long.
+// Every status record is a range start and the bytes written from it, so ranges that were
+// split or stopped half way resume from the first missing byte.
 func (p *Progress) GetTasks(total int64, chunkSize int64) map[int64]int64 {
 	if total == 0 {
 		return nil
 	}
 
-	tasks := make(map[int64]int64)
-	tools.AddUncovered(tasks, 0, total, chunkSize)
+	covered := tools.MergeRanges(p.records(total))
+	tasks := tools.FindUncoveredPositions(total, covered, chunkSize)
 
-	l := p.cache.Len()
-	if l > 1 {
-		orderList := make([]int64, 0, l)
-		lastLen := int64(0)
+	lastLen := int64(0)
+	for i := 0; i+1 < len(covered); i += 2 {
+		lastLen += covered[i+1] - covered[i]
+	}
+	zap.L().Info("has already find cache", zap.Int64("done", lastLen), zap.Int("tasks", len(tasks)))
+	p.done.Store(lastLen)
+	if p.bar != nil && lastLen > 0 {
+		p.bar.SetCurrent(lastLen)
+	}
+	return tasks
+}
 
-		for start, end := range tasks {
-			var key bytes.Buffer
-			_ = binary.Write(&key, binary.BigEndian, start)
-			v, err := p.cache.Get(key.String())
-			if err != nil {
-				continue
-			}
-			length := int64(binary.BigEndian.Uint64(v))
-			if (length + start) >= end {
-				orderList = append(orderList, start)
-				lastLen += length
-			}
+// records reads the ranges on disk as start -> end, capped at total unless it is 0.
+func (p *Progress) records(total int64) map[int64]int64 {
+	done := make(map[int64]int64)
+	if p.cache == nil || p.cache.Len() <= 1 {
+		return done
+	}
+	_ = p.cache.Fetch(func(key string, value []byte) bool {
+		if len(key) != 8 || len(value) != 8 {
+			return false
 		}
-		zap.L().Info("has already find cache", zap.Int("orderList", len(orderList)))
-		for _, k := range orderList {
-			delete(tasks, k)
+		start := int64(binary.BigEndian.Uint64([]byte(key)))
+		end := start + int64(binary.BigEndian.Uint64(value))
+		if total > 0 && end > total {
+			end = total
 		}
-		if p.bar != nil {
-			p.bar.SetCurrent(lastLen)
+		if end > done[start] {
+			done[start] = end
 		}
+		return false
+	})
+	return done
+}
+
+// SetDynamic makes the bar follow a download of unknown size.
+func (p *Progress) SetDynamic(dynamic bool) {
+	p.dynamic = dynamic
+}
+
+// Complete fixes the total of a dynamic bar to what was downloaded.
+func (p *Progress) Complete() {
+	if p.dynamic {
+		display.DynComplete(p.bar)
 	}
-	return tasks
+}
+
+// Written returns how many bytes from the start of the file are on disk, the resume
+// point of a stream of unknown size.
+func (p *Progress) Written() int64 {
+	covered := tools.MergeRanges(p.records(0))
+	if len(covered) < 2 || covered[0] != 0 {
+		return 0
+	}
+	p.done.Store(covered[1])
+	if p.bar != nil {
+		p.bar.SetCurrent(covered[1])
+		if p.dynamic {
+			display.DynInrTotal(p.bar)
+		}
+	}
+	return covered[1]
 }
 
 func (p *Progress) Close() {
@@ -97,20 +140,39 @@ func (p *Progress) Close() {
 		_ = p.cache.Close()
 	}
 }
+
+// UpdateStatus shows data on the bar and records it at once.
 func (p *Progress) UpdateStatus(data FileData) {
+	p.Record(data.GetStart(), data.GetOffsetLen())
+	p.Show(data)
+}
+
+// Record persists that length bytes from the range start are in the file.
+// Call it only once those bytes are on disk.
+func (p *Progress) Record(start, length int64) {
 	if p.cache != nil {
-		offset := data.GetStart()
-		l := data.GetOffsetLen()
 		var key bytes.Buffer
 		var val bytes.Buffer
-		_ = binary.Write(&key, binary.BigEndian, offset)
-		_ = binary.Write(&val, binary.BigEndian, l)
+		_ = binary.Write(&key, binary.BigEndian, start)
+		_ = binary.Write(&val, binary.BigEndian, length)
 		_ = p.cache.Set(key.String(), val.Bytes())
 	}
+}
+
+// Done returns how many bytes are in the file.
+func (p *Progress) Done() int64 {
+	return p.done.Load()
+}
+
+func (p *Progress) Show(data FileData) {
+	p.done.Add(int64(data.GetDataLen()))
 	if p.bar != nil {
 		pos := data.GetDataLen()
 		x := time.Since(p.curr)
 		display.InCr(p.bar, pos, x)
+		if p.dynamic {
+			display.DynInrTotal(p.bar)
+		}
 		p.curr = time.Now()
 	}
 }
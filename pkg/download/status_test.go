@@ -32,6 +32,7 @@ func (j *jobStatus) GetStart() int64 {
 func (j *jobStatus) GetOffsetLen() int64 {
 	return j.l
 }
+func (j *jobStatus) Release() {}
 
 func Test_Process(t *testing.T) {
 	err := log.DevLog()
@@ -177,3 +178,38 @@ func Test_cache(t *testing.T) {
 		t.Fatal("not get failed")
 	}
 }
+
+func Test_GetTasks(t *testing.T) {
+	err := log.DevLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProgress(nil)
+	err = p.InitCache("gettasks", statusSuffix, []byte("meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		p.Close()
+		_ = os.Remove("gettasks.xz3")
+	}()
+
+	// [0,100) done, [100,200) stopped at 150, [200,250) was split off and is done
+	for _, data := range []jobStatus{{offset: 0, l: 100}, {offset: 100, l: 50}, {offset: 200, l: 50}} {
+		p.UpdateStatus(&data)
+	}
+	tasks := p.GetTasks(400, 100)
+	want := map[int64]int64{150: 200, 250: 350, 350: 400}
+	if len(tasks) != len(want) {
+		t.Fatal(tasks)
+	}
+	for k, v := range want {
+		if tasks[k] != v {
+			t.Fatal(tasks)
+		}
+	}
+	// a stream of unknown size resumes after the contiguous part
+	if n := p.Written(); n != 150 {
+		t.Fatal("written", n)
+	}
+}
@@ -0,0 +1,96 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// chunkedServer streams data without Content-Length, the download after the job's first
+// request is cut off half way. total is what the range probe reports, "*" when unknown.
+func chunkedServer(data []byte, total string, ranges bool) (*httptest.Server, *atomic.Int32) {
+	var resumed atomic.Int32
+	var full atomic.Int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from := 0
+		if r.Header.Get("Range") == "" {
+			full.Add(1)
+		}
+		if v := r.Header.Get("Range"); v != "" && ranges {
+			spec := strings.TrimPrefix(v, "bytes=")
+			if spec == "0-0" {
+				w.Header().Set("Content-Range", "bytes 0-0/"+total)
+				w.Header().Set("Content-Length", "1")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data[:1])
+				return
+			}
+			from, _ = strconv.Atoi(strings.TrimSuffix(spec, "-"))
+			resumed.Add(1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", from, len(data)-1, total))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		cut := ranges && from == 0 && full.Load() == 2
+		flusher := w.(http.Flusher)
+		for i := from; i < len(data); i += 1000 {
+			end := i + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write(data[i:end])
+			flusher.Flush()
+			if cut && i >= len(data)/2 {
+				// close the connection without the last chunk
+				panic(http.ErrAbortHandler)
+			}
+		}
+	})), &resumed
+}
+
+func Test_Job_UnknownSize(t *testing.T) {
+	data := []byte(textGenerator(50000))
+	for _, c := range []struct {
+		name   string
+		total  string
+		ranges bool
+	}{
+		{"no ranges", "*", false},
+		{"unknown total", "*", true},
+		{"probed total", strconv.Itoa(len(data)), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server, resumed := chunkedServer(data, c.total, c.ranges)
+			defer server.Close()
+
+			file := filepath.Join(t.TempDir(), "stream.bin")
+			cfg := task.NewDownloadConfig()
+			cfg.RetryCount = 0
+			u, _ := url.Parse(server.URL)
+			job := NewHttpTask(context.Background(), u, file, true, cfg, nil)
+			if err := job.Start(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("data not equal", len(got))
+			}
+			if c.ranges && resumed.Load() != 1 {
+				t.Fatal("early close not resumed", resumed.Load())
+			}
+		})
+	}
+}
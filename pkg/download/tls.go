@@ -0,0 +1,132 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// WithTLS sets the TLS config of the transport, an invalid config fails every https request.
+// cfg.ServerName is only used for the hosts of origins, or for every host without them,
+// mirrors, redirects and key servers elsewhere are verified by their own name.
+func WithTLS(cfg task.TLSConfig, origins ...string) ClientOption {
+	return func(s *clientSetup) {
+		s.transport.TLS = cfg
+		s.serverNameHosts = nil
+		for _, origin := range origins {
+			if u, err := url.Parse(origin); err == nil && u.Host != "" {
+				if s.serverNameHosts == nil {
+					s.serverNameHosts = make(map[string]bool)
+				}
+				s.serverNameHosts[strings.ToLower(u.Host)] = true
+			}
+		}
+	}
+}
+
+// serverNameTransport sends the requests to the hosts of the ServerName override over
+// named, the others over plain.
+type serverNameTransport struct {
+	hosts map[string]bool
+	named http.RoundTripper
+	plain http.RoundTripper
+}
+
+func (t *serverNameTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.hosts[strings.ToLower(req.URL.Host)] {
+		return t.named.RoundTrip(req)
+	}
+	return t.plain.RoundTrip(req)
+}
+
+func setTLS(t *http.Transport, cfg task.TLSConfig) {
+	conf, err := tlsConfig(cfg)
+	if err != nil {
+		t.DialTLSContext = func(context.Context, string, string) (net.Conn, error) {
+			return nil, err
+		}
+		return
+	}
+	t.TLSClientConfig = conf
+}
+
+// ValidateTLS loads the files of cfg and reports what WithTLS would fail with.
+func ValidateTLS(cfg task.TLSConfig) error {
+	_, err := tlsConfig(cfg)
+	return task.Invalid("tls", err)
+}
+
+// tlsConfig returns nil for an empty cfg so the transport keeps its defaults.
+func tlsConfig(cfg task.TLSConfig) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && cfg.MinVersion == "" &&
+		cfg.ServerName == "" && len(cfg.Pins) == 0 {
+		return nil, nil
+	}
+	conf := &tls.Config{ServerName: cfg.ServerName}
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[strings.TrimPrefix(cfg.MinVersion, "TLS")]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %q", cfg.MinVersion)
+		}
+		conf.MinVersion = v
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", cfg.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if len(cfg.Pins) > 0 {
+		pins := make(map[string]bool, len(cfg.Pins))
+		for _, p := range cfg.Pins {
+			p = strings.TrimPrefix(strings.TrimSpace(p), "sha256//")
+			if b, err := base64.StdEncoding.DecodeString(p); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q", p)
+			}
+			pins[p] = true
+		}
+		// runs after the normal verification, the pin narrows it down
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("no pinned public key in the chain of %s", state.ServerName)
+		}
+	}
+	return conf, nil
+}
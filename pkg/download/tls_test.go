@@ -0,0 +1,141 @@
+package download
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func writePEM(t *testing.T, name, kind string, der []byte) string {
+	name = filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// clientCert writes a self signed client certificate and key.
+func clientCert(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hls"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, writePEM(t, "client.crt", "CERTIFICATE", der), writePEM(t, "client.key", "EC PRIVATE KEY", keyDer)
+}
+
+func tlsClient(t *testing.T, cfg task.TLSConfig) MyClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewClient(ctx, 0, time.Second, time.Second, WithTLS(cfg))
+}
+
+func tryGet(client MyClient, url string) error {
+	req, err := client.NewRequest(url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func Test_tlsConfig(t *testing.T) {
+	cert, certFile, keyFile := clientCert(t)
+	clients := x509.NewCertPool()
+	clients.AddCert(cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	server.StartTLS()
+	defer server.Close()
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	sum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+
+	cfg := task.TLSConfig{CAFile: ca, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2", Pins: []string{pin}}
+	if err := tryGet(tlsClient(t, cfg), server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// the test certificate is issued for example.com
+	sni := cfg
+	sni.ServerName = "example.com"
+	if err := tryGet(tlsClient(t, sni), server.URL); err != nil {
+		t.Fatal("sni", err)
+	}
+	sni.ServerName = "other.example"
+	if err := tryGet(tlsClient(t, sni), server.URL); err == nil {
+		t.Fatal("wrong server name accepted")
+	}
+	// the override is kept to the origin, other hosts are verified by their own name
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	origin := NewClient(ctx, 0, time.Second, time.Second, WithTLS(sni, server.URL))
+	if err := tryGet(origin, server.URL); err == nil {
+		t.Fatal("server name not used for the origin")
+	}
+	mirror := NewClient(ctx, 0, time.Second, time.Second, WithTLS(sni, "https://origin.example/"))
+	if err := tryGet(mirror, server.URL); err != nil {
+		t.Fatal("server name used for another host", err)
+	}
+
+	noCert := cfg
+	noCert.CertFile, noCert.KeyFile = "", ""
+	if err := tryGet(tlsClient(t, noCert), server.URL); err == nil {
+		t.Fatal("server accepted a client without certificate")
+	}
+
+	noCA := cfg
+	noCA.CAFile = ""
+	if err := tryGet(tlsClient(t, noCA), server.URL); err == nil {
+		t.Fatal("unknown CA accepted")
+	}
+
+	other := sha256.Sum256([]byte("other"))
+	pinned := cfg
+	pinned.Pins = []string{base64.StdEncoding.EncodeToString(other[:])}
+	if err := tryGet(tlsClient(t, pinned), server.URL); err == nil {
+		t.Fatal("pin not checked")
+	}
+
+	if err := ValidateTLS(task.TLSConfig{MinVersion: "1.4"}); err == nil {
+		t.Fatal("want version error")
+	}
+	if err := ValidateTLS(task.TLSConfig{Pins: []string{"abc"}}); err == nil {
+		t.Fatal("want pin error")
+	}
+}
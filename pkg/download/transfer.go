@@ -6,10 +6,8 @@ import (
 	"fmt"
 	"io"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/chestnutsj/hls/pkg/task"
 	"go.uber.org/zap"
 )
 
@@ -17,53 +15,181 @@ type Transfer struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
 	client   MyClient
-	url      string
+	mirrors  *mirrorSet
 	buffSize int64
-	status   *atomic.Int32
+	pause    *Pauser
 	header   map[string]string
+	limiters []*RateLimiter
+	minSplit int64
+	// splitAlign is the piece length the stolen ranges start on
+	splitAlign int64
+	// encoding is EncodingDecode, EncodingRaw or EncodingIdentity for single streams
+	encoding string
+	// sources read the urls, the others are fetched with client
+	sources map[string]Source
 }
 
-func NewTransfer(ctx context.Context, status *atomic.Int32, client MyClient, url string, header map[string]string, bufSize int64) *Transfer {
+// NewTransfer reads url with client, pause may be shared with the owning job or nil.
+func NewTransfer(ctx context.Context, pause *Pauser, client MyClient, url string, header map[string]string, bufSize int64) *Transfer {
 	ctx, cancel := context.WithCancel(ctx)
+	if pause == nil {
+		pause = NewPauser(ctx)
+	}
 	return &Transfer{
 		ctx:      ctx,
 		cancel:   cancel,
 		client:   client,
-		url:      url,
+		mirrors:  newMirrorSet(url),
 		buffSize: bufSize,
 		header:   header,
-		status:   status,
+		pause:    pause,
+		limiters: []*RateLimiter{globalLimiter},
+		minSplit: minSplitSize,
+		encoding: EncodingDecode,
+	}
+}
+
+// AddMirror adds another url serving the same file, range requests are spread over all of them.
+func (t *Transfer) AddMirror(url string) {
+	t.mirrors.add(url)
+}
+
+// AlignSplits makes an idle connection steal only ranges starting on a multiple of n,
+// so each piece of a checksum is fetched by one connection.
+func (t *Transfer) AlignSplits(n int64) {
+	t.splitAlign = n
+}
+
+// AddLimiter throttles this transfer with l in addition to the global limiter.
+func (t *Transfer) AddLimiter(l *RateLimiter) {
+	if l != nil {
+		t.limiters = append(t.limiters, l)
 	}
 }
 
+// SetSource reads url from src instead of the client, call it before the download.
+func (t *Transfer) SetSource(url string, src Source) {
+	if t.sources == nil {
+		t.sources = make(map[string]Source)
+	}
+	t.sources[url] = src
+}
+
+// sourceOf returns the source of url, urls without one are read with the client.
+func (t *Transfer) sourceOf(url string) Source {
+	if src, ok := t.sources[url]; ok {
+		return src
+	}
+	return &httpSource{client: t.client, url: url, header: t.header, encoding: t.encoding}
+}
+
+// SetEncoding chooses what a single stream does with a Content-Encoding, ranged
+// requests always ask for identity.
+func (t *Transfer) SetEncoding(mode string) {
+	if mode == "" {
+		mode = EncodingDecode
+	}
+	t.encoding = mode
+}
+
+func (t *Transfer) wait(ctx context.Context, n int) error {
+	for _, l := range t.limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadPerThread fetches [start, end), an end of 0 reads until EOF.
 func (t *Transfer) DownloadPerThread(write chan FileData, start, end int64) error {
-	ctx, cancel := context.WithCancel(t.ctx)
-	defer cancel()
+	return t.fetch(write, newSegment(start, end))
+}
 
-	req, err := t.client.NewRequest(t.url, t.header)
-	if err != nil {
-		return err
+// DownloadStream reads the whole file over one connection from pos. size is the length
+// when it is known, 0 otherwise, a stream ending before it was closed early. A server
+// with ranges is asked for the rest after an early close while every attempt makes progress.
+func (t *Transfer) DownloadStream(write chan FileData, pos, size int64, ranged bool) error {
+	seg := &segment{start: 0, pos: pos}
+	for {
+		before, _ := seg.bounds()
+		err := t.fetch(write, seg)
+		if t.ctx.Err() != nil {
+			return nil
+		}
+		after, _ := seg.bounds()
+		if err == nil && size > 0 && after < size {
+			err = fmt.Errorf("stream ended at %d of %d: %w", after, size, io.ErrUnexpectedEOF)
+		}
+		if err == nil || !ranged || !errors.Is(err, io.ErrUnexpectedEOF) || after == before {
+			return err
+		}
+		zap.L().Warn("connection closed early, resume", zap.Int64("pos", after), zap.Error(err))
 	}
-	if end != 0 {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
-		zap.L().Debug("download", zap.Int64("start", start), zap.Int64("end", end))
+}
+
+func (t *Transfer) fetch(write chan FileData, seg *segment) error {
+	src := t.mirrors.pick()
+	start, _ := seg.bounds()
+	begin := time.Now()
+	err := t.fetchFrom(src.url, write, seg)
+	pos, _ := seg.bounds()
+	t.mirrors.release(src, pos-start, time.Since(begin), err != nil)
+	return err
+}
+
+// fetchFrom reads the rest of seg from url. A pause cancels the request, it is issued
+// again from the first missing byte once the transfer is resumed.
+func (t *Transfer) fetchFrom(url string, write chan FileData, seg *segment) error {
+	for {
+		epoch, err := t.pause.Wait()
+		if err != nil || t.ctx.Err() != nil {
+			return nil
+		}
+		err = t.fetchOnce(epoch, url, write, seg)
+		if t.ctx.Err() != nil {
+			return nil
+		}
+		if epoch.Err() != nil && !seg.finished() {
+			zap.L().Debug("transfer paused", zap.String("url", url))
+			continue
+		}
+		return err
 	}
+}
+
+func (t *Transfer) fetchOnce(epoch context.Context, url string, write chan FileData, seg *segment) error {
+	ctx, cancel := context.WithCancel(epoch)
+	defer cancel()
+	stop := context.AfterFunc(t.ctx, cancel)
+	defer stop()
 
-	resp, err := t.client.Do(req)
+	start, end := seg.bounds()
+	body, start, err := t.open(ctx, url, start, end, seg.start)
 	if err != nil {
 		return err
 	}
-	if resp == nil {
-		return nil
-	}
-	defer resp.Body.Close()
+	defer body.Close()
 
-	if resp.StatusCode != 200 && resp.StatusCode != 206 {
-		return fmt.Errorf("%s resp is failed code:%s", t.url, resp.Status)
+	// reads up to the chunk size, the pooled buffers are handed to the writer and a
+	// larger buffer is reused with each read copied out
+	bufSize := int(t.buffSize)
+	if bufSize <= 0 {
+		bufSize = readBufferSize
+	}
+	pooled := bufSize <= readBufferSize
+	var buffer *[]byte
+	if pooled {
+		buffer = getBuffer()
+		defer func() {
+			if buffer != nil {
+				bufPool.Put(buffer)
+			}
+		}()
+	} else {
+		b := make([]byte, bufSize)
+		buffer = &b
 	}
-	// zap.L().Debug("resp", zap.Any("head", resp.Header))
-
-	buffer := make([]byte, t.buffSize)
 	offset := start
 	var n int
 	for {
@@ -73,66 +199,115 @@ func (t *Transfer) DownloadPerThread(write chan FileData, start, end int64) erro
 				return nil
 			}
 		default:
-			if t.status.Load() == task.Running {
-				n, err = resp.Body.Read(buffer)
-				if err != nil && err != io.EOF {
-					if errors.Is(err, context.Canceled) {
-						return nil
-					}
-					zap.L().Error("read failed", zap.Error(err))
-					return err
-				}
-				if n > 0 {
-					f := NewFileData(offset, buffer[:n], start)
-					select {
-					case <-ctx.Done():
-						zap.L().Warn("context cancel")
-						return nil
-					case write <- f:
-						{
-							offset += int64(n)
-						}
-					}
+			n, err = body.Read((*buffer)[:bufSize])
+			if err != nil && err != io.EOF {
+				if ctx.Err() != nil {
+					return nil
 				}
-				if err == io.EOF {
+				zap.L().Error("read failed", zap.Error(err))
+				return err
+			}
+			// the tail may have been handed to another connection
+			n = seg.clip(offset, n)
+			if n > 0 {
+				if t.wait(ctx, n) != nil {
 					return nil
 				}
-				if end != 0 && offset > end {
+				var f FileData
+				if pooled {
+					f = newPooledFileData(offset, buffer, n, seg.start)
+				} else {
+					f = NewFileData(offset, (*buffer)[:n], seg.start)
+				}
+				select {
+				case <-ctx.Done():
+					zap.L().Debug("context cancel")
+					f.Release()
+					if pooled {
+						buffer = nil
+					}
 					return nil
+				case write <- f:
+					{
+						if pooled {
+							// the writer owns the buffer now
+							buffer = getBuffer()
+						}
+						offset += int64(n)
+						seg.commit(offset)
+					}
 				}
-			} else {
-				<-time.After(time.Second)
+			}
+			if seg.finished() {
+				return nil
+			}
+			if err == io.EOF {
+				if end != 0 {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
 			}
 		}
 	}
 }
 
+// open returns the body of [start, end) and where it really starts, an HTTP server
+// without ranges starts over at from.
+func (t *Transfer) open(ctx context.Context, url string, start, end, from int64) (io.ReadCloser, int64, error) {
+	src := t.sourceOf(url)
+	if hs, ok := src.(*httpSource); ok {
+		return hs.open(ctx, start, end, from)
+	}
+	var length int64
+	if end != 0 {
+		length = end - start
+	}
+	body, err := src.Open(ctx, start, length)
+	return body, start, err
+}
+
+// DownloadMtiThread runs a pool of ThreadSize connections over the ranges [start, end) of ms.
+// A connection that runs out of work splits the largest range still in flight, or waits
+// for one to come back from a failed connection.
 func (t *Transfer) DownloadMtiThread(write chan FileData, ThreadSize int, ms map[int64]int64) error {
 	wg := sync.WaitGroup{}
-	limit := make(chan struct{}, ThreadSize)
+	sched := newScheduler(ms, t.minSplit)
+	sched.align = t.splitAlign
+	var mu sync.Mutex
 	var err error
 
-	for k, v := range ms {
+	for i := 0; i < ThreadSize; i++ {
 		wg.Add(1)
-		go func(start, end int64) {
-			defer func() {
-				<-limit
-				wg.Done()
-			}()
-			limit <- struct{}{}
-			if t.ctx.Err() != nil {
-				return
-			}
-			xErr := t.DownloadPerThread(write, start, end)
-			if xErr != nil {
-				if !errors.Is(xErr, context.Canceled) {
-					zap.L().Error("DownloadPerThread failed", zap.Error(xErr))
+		go func() {
+			defer wg.Done()
+			for t.ctx.Err() == nil {
+				seg := sched.wait(t.ctx)
+				if seg == nil {
+					return
+				}
+				xErr := t.fetch(write, seg)
+				sched.done(seg)
+				if xErr != nil {
+					if !errors.Is(xErr, context.Canceled) {
+						zap.L().Error("DownloadPerThread failed", zap.Error(xErr))
+					}
+					mu.Lock()
+					err = xErr
+					mu.Unlock()
+					if t.mirrors.healthy() > 0 {
+						// another mirror can serve the rest
+						continue
+					}
+					// drop this connection, the others pick up what is left
+					return
 				}
-				err = xErr
 			}
-		}(k, v)
+		}()
 	}
 	wg.Wait()
 	zap.L().Info("DownloadMtiThread exit")
+	if sched.left() == 0 {
+		return nil
+	}
 	return err
 }
@@ -7,6 +7,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -14,7 +16,6 @@ import (
 	"time"
 
 	"github.com/chestnutsj/hls/pkg/log"
-	"github.com/chestnutsj/hls/pkg/task"
 	"go.uber.org/zap"
 )
 
@@ -82,7 +83,6 @@ func Test_transfer(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	status := atomic.Int32{}
 	client := NewClient(ctx, 3, time.Second*3, time.Second*30)
 
 	readChan := make(chan FileData, 3)
@@ -102,8 +102,7 @@ func Test_transfer(t *testing.T) {
 		}
 	}()
 
-	tr := NewTransfer(ctx, &status, client, ts.URL, nil, int64(dataLen/10))
-	status.Store(task.Running)
+	tr := NewTransfer(ctx, nil, client, ts.URL, nil, int64(dataLen/10))
 	err = tr.DownloadPerThread(readChan, 0, 0)
 	if err != nil {
 		t.Fatal(err)
@@ -131,6 +130,44 @@ func Test_transfer(t *testing.T) {
 	}
 }
 
+// a chunk size above the pooled buffers still sets how much one read takes
+func Test_transferChunkSize(t *testing.T) {
+	data := []byte(textGenerator(1000000))
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	const chunk = 4 * readBufferSize
+	ctx := context.Background()
+	tr := NewTransfer(ctx, nil, NewClient(ctx, 0, time.Second, time.Second), path, nil, chunk)
+	tr.SetSource(path, &fileSource{path: path})
+
+	readChan := make(chan FileData, 3)
+	var rev []byte
+	largest := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for rd := range readChan {
+			rev = append(rev, rd.GetData()...)
+			largest = max(largest, rd.GetDataLen())
+			rd.Release()
+		}
+	}()
+	err := tr.DownloadPerThread(readChan, 0, 0)
+	close(readChan)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rev, data) {
+		t.Fatal("data not equal")
+	}
+	if largest != chunk {
+		t.Fatal("reads not of the chunk size", largest)
+	}
+}
+
 func Test_transfer_muti(t *testing.T) {
 	err := log.DevLog()
 	if err != nil {
@@ -160,7 +197,6 @@ func Test_transfer_muti(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	status := atomic.Int32{}
 	client := NewClient(ctx, 3, time.Second*3, time.Second*30)
 
 	readChan := make(chan FileData, 3)
@@ -180,8 +216,7 @@ func Test_transfer_muti(t *testing.T) {
 		}
 	}()
 
-	tr := NewTransfer(ctx, &status, client, ts.URL, nil, int64(dataLen/10))
-	status.Store(task.Running)
+	tr := NewTransfer(ctx, nil, client, ts.URL, nil, int64(dataLen/10))
 	err = tr.DownloadPerThread(readChan, 0, 0)
 	if err != nil {
 		t.Fatal(err)
@@ -208,3 +243,127 @@ func Test_transfer_muti(t *testing.T) {
 
 	}
 }
+
+func Test_transfer_steal(t *testing.T) {
+	err := log.DevLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dataLen := 1000000
+	data := []byte(textGenerator(dataLen))
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeContent(w, r, "data", time.Now(), bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	client := NewClient(ctx, 3, time.Second*3, time.Second*30)
+
+	readChan := make(chan FileData, 3)
+	rev := make([]byte, len(data))
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for rd := range readChan {
+			copy(rev[rd.GetPos():], rd.GetData())
+		}
+	}()
+
+	tr := NewTransfer(ctx, nil, client, ts.URL, nil, 4096)
+	tr.minSplit = 1024
+	// one big range and four connections, the idle ones have to split it
+	err = tr.DownloadMtiThread(readChan, 4, map[int64]int64{0: int64(dataLen)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(readChan)
+	wg.Wait()
+
+	if !bytes.Equal(data, rev) {
+		t.Fatal("data not equal")
+	}
+	if requests.Load() < 2 {
+		t.Fatal("range was not split", requests.Load())
+	}
+}
+
+// slowReader serves a few bytes at a time so a transfer can be paused half way.
+type slowReader struct {
+	*bytes.Reader
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if len(p) > 1024 {
+		p = p[:1024]
+	}
+	return r.Reader.Read(p)
+}
+
+func Test_transfer_pause(t *testing.T) {
+	err := log.DevLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dataLen := 300000
+	data := []byte(textGenerator(dataLen))
+
+	var active atomic.Int32
+	ranges := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active.Add(1)
+		defer active.Add(-1)
+		ranges <- r.Header.Get("Range")
+		http.ServeContent(w, r, "data", time.Time{}, slowReader{bytes.NewReader(data)})
+	}))
+	defer ts.Close()
+
+	client := NewClient(ctx, 3, time.Second*3, time.Second*30)
+	readChan := make(chan FileData, 3)
+	rev := make([]byte, len(data))
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for rd := range readChan {
+			copy(rev[rd.GetPos():], rd.GetData())
+		}
+	}()
+
+	pause := NewPauser(ctx)
+	tr := NewTransfer(ctx, pause, client, ts.URL, nil, 4096)
+	done := make(chan error)
+	go func() {
+		done <- tr.DownloadMtiThread(readChan, 1, map[int64]int64{0: int64(dataLen)})
+	}()
+
+	<-time.After(100 * time.Millisecond)
+	pause.Pause()
+	<-time.After(300 * time.Millisecond)
+	if active.Load() != 0 {
+		t.Fatal("connection kept open while paused")
+	}
+	pause.Resume()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	close(readChan)
+	wg.Wait()
+	close(ranges)
+
+	if !bytes.Equal(data, rev) {
+		t.Fatal("data not equal")
+	}
+	var seen []string
+	for r := range ranges {
+		seen = append(seen, r)
+	}
+	if len(seen) != 2 || seen[0] != "bytes=0-299999" || seen[1] == seen[0] {
+		t.Fatal("resume should continue the range", seen)
+	}
+}
@@ -0,0 +1,196 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+	"go.uber.org/zap"
+)
+
+// transportConfig is everything that changes the transport, clients with the same one
+// share connections.
+type transportConfig struct {
+	ConnTimeout time.Duration
+	IdleTimeout time.Duration
+	Proxy       task.ProxyConfig
+	TLS         task.TLSConfig
+	Network     task.NetworkConfig
+}
+
+var (
+	transportLock sync.Mutex
+	transports    = make(map[string]*http.Transport)
+)
+
+// WithNetwork sets the connection policy of the transport.
+func WithNetwork(cfg task.NetworkConfig) ClientOption {
+	return func(s *clientSetup) {
+		s.transport.Network = cfg
+	}
+}
+
+// sharedTransport returns the transport of the process for cfg, the m3u task and all
+// of its segment jobs end up on the same one and reuse the keep-alive connections.
+func sharedTransport(cfg transportConfig) *http.Transport {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return newTransport(cfg)
+	}
+	key := string(data)
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if t, ok := transports[key]; ok {
+		return t
+	}
+	t := newTransport(cfg)
+	transports[key] = t
+	return t
+}
+
+func newTransport(cfg transportConfig) *http.Transport {
+	dialer := &net.Dialer{Timeout: cfg.ConnTimeout}
+	resolve, err := parseResolve(cfg.Network.Resolve)
+	if err != nil {
+		zap.L().Warn("ignore resolve overrides", zap.Error(err))
+	}
+	d := &hostDialer{
+		dialer:  dialer,
+		resolve: resolve,
+		cache:   newDNSCache(time.Duration(cfg.Network.DNSCacheTTL) * time.Second),
+	}
+	t := &http.Transport{
+		DialContext:         d.DialContext,
+		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        100,
+		MaxConnsPerHost:     cfg.Network.MaxConnsPerHost,
+		IdleConnTimeout:     cfg.IdleTimeout,
+		// the custom dialer keeps HTTP/2 off unless it is forced
+		ForceAttemptHTTP2: cfg.Network.HTTP2,
+	}
+	setProxy(t, cfg.Proxy)
+	setTLS(t, cfg.TLS)
+	return t
+}
+
+// parseResolve reads curl style "host:port:address" overrides.
+func parseResolve(list []string) (map[string]string, error) {
+	resolve := make(map[string]string, len(list))
+	for _, r := range list {
+		host, rest, ok := strings.Cut(r, ":")
+		if !ok {
+			return resolve, fmt.Errorf("invalid resolve %q, want host:port:address", r)
+		}
+		port, addr, ok := strings.Cut(rest, ":")
+		if !ok || port == "" || addr == "" {
+			return resolve, fmt.Errorf("invalid resolve %q, want host:port:address", r)
+		}
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if net.ParseIP(addr) == nil {
+			return resolve, fmt.Errorf("invalid address in resolve %q", r)
+		}
+		resolve[net.JoinHostPort(strings.ToLower(host), port)] = addr
+	}
+	return resolve, nil
+}
+
+// hostDialer applies the resolve overrides and the dns cache before dialing.
+type hostDialer struct {
+	dialer  *net.Dialer
+	resolve map[string]string
+	cache   *dnsCache
+}
+
+func (d *hostDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	if ip, ok := d.resolve[net.JoinHostPort(strings.ToLower(host), port)]; ok {
+		return d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	}
+	if d.cache == nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	ips, err := d.cache.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// the addresses may be stale
+	d.cache.forget(host)
+	return nil, err
+}
+
+type dnsEntry struct {
+	ips     []string
+	expires time.Time
+}
+
+// dnsCache keeps lookups for ttl, so the segments of a playlist don't resolve the cdn each time.
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsEntry
+	now     func() time.Time
+	resolve func(ctx context.Context, host string) ([]string, error)
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &dnsCache{
+		ttl:     ttl,
+		entries: make(map[string]dnsEntry),
+		now:     time.Now,
+		resolve: net.DefaultResolver.LookupHost,
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && c.now().Before(e.expires) {
+		return e.ips, nil
+	}
+	ips, err := c.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address for %s", host)
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{ips: ips, expires: c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return ips, nil
+}
+
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, host)
+}
+
+// ValidateNetwork reports the resolve overrides that would be ignored.
+func ValidateNetwork(cfg task.NetworkConfig) error {
+	_, err := parseResolve(cfg.Resolve)
+	return task.Invalid("network", err)
+}
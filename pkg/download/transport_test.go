@@ -0,0 +1,127 @@
+package download
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+func Test_sharedTransport(t *testing.T) {
+	cfg := task.NewDownloadConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := NewClient(ctx, 0, time.Second, time.Second, ConfigOptions(cfg, "http://a.example/")...).(*myClient)
+	b := NewClient(ctx, 0, time.Second, time.Second, ConfigOptions(cfg, "http://b.example/")...).(*myClient)
+	if a.client.Transport != b.client.Transport {
+		t.Fatal("same config, different transports")
+	}
+	other := *cfg
+	other.Network.MaxConnsPerHost = 2
+	c := NewClient(ctx, 0, time.Second, time.Second, ConfigOptions(&other, "http://a.example/")...).(*myClient)
+	if a.client.Transport == c.client.Transport {
+		t.Fatal("different config, same transport")
+	}
+}
+
+func Test_transportMaxConns(t *testing.T) {
+	var active, peak atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			if n := active.Add(1); n > peak.Load() {
+				peak.Store(n)
+			}
+		case http.StateClosed, http.StateHijacked:
+			active.Add(-1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		// one client per job, the limit holds over all of them
+		client := NewClient(ctx, 0, time.Second, time.Second, WithNetwork(task.NetworkConfig{MaxConnsPerHost: 2}))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(t, client, server.URL)
+		}()
+	}
+	wg.Wait()
+	if peak.Load() > 2 {
+		t.Fatal("connections", peak.Load())
+	}
+}
+
+func Test_transportResolveAndHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	u, _ := url.Parse(server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the test certificate is valid for example.com, which resolves to the test server
+	network := task.NetworkConfig{Resolve: []string{"example.com:" + u.Port() + ":127.0.0.1"}}
+	// HTTP/1.1 by default, the range threads get a connection each
+	client := NewClient(ctx, 0, time.Second, time.Second, WithTLS(task.TLSConfig{CAFile: ca}), WithNetwork(network))
+	if resp := get(t, client, "https://example.com:"+u.Port()+"/"); resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Fatal(resp.Status)
+	}
+	network.HTTP2 = true
+	client = NewClient(ctx, 0, time.Second, time.Second, WithTLS(task.TLSConfig{CAFile: ca}), WithNetwork(network))
+	if resp := get(t, client, "https://example.com:"+u.Port()+"/"); resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+
+	if err := ValidateNetwork(task.NetworkConfig{Resolve: []string{"example.com:443"}}); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func Test_dnsCache(t *testing.T) {
+	now := time.Now()
+	var lookups int
+	c := newDNSCache(time.Minute)
+	c.now = func() time.Time { return now }
+	c.resolve = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, nil
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.lookup(context.Background(), "cdn.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatal("lookups", lookups)
+	}
+	now = now.Add(time.Minute)
+	c.lookup(context.Background(), "cdn.example")
+	if lookups != 2 {
+		t.Fatal("expired entry reused")
+	}
+	if newDNSCache(0) != nil {
+		t.Fatal("ttl 0 should disable the cache")
+	}
+}
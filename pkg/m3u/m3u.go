@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/chestnutsj/hls/pkg/display"
 	"github.com/chestnutsj/hls/pkg/download"
 	"github.com/chestnutsj/hls/pkg/log"
@@ -14,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -43,6 +45,13 @@ type Task struct {
 	cfg     task.Config
 	info    map[string]interface{}
 	lock    sync.Mutex
+	// segments is the number of entries of the playlist, skipped the ones a previous
+	// run completed
+	segments atomic.Int64
+	skipped  atomic.Int64
+	renew    *renewer
+	// restored are the segments the manager queued again from its status file
+	restored map[string]bool
 }
 
 func (t *Task) GetType() string {
@@ -53,14 +62,15 @@ func (t *Task) GetStatus() task.Status {
 	return t.status.Load()
 }
 
+// Stop pauses every segment job, the queued ones wait for Resume.
 func (t *Task) Stop() error {
 	t.status.Store(task.Paused)
-	return nil
+	return t.tasks.StopAll()
 }
 
 func (t *Task) Resume() error {
 	t.status.Store(task.Running)
-	return nil
+	return t.tasks.ResumeAll()
 }
 
 func (t *Task) Exit() error {
@@ -74,8 +84,24 @@ func (t *Task) Extra() ([]byte, error) {
 	return json.Marshal(t.info)
 }
 
+// NewM3uTaskCache rebuilds a task from its Extra, the playlist is fetched again.
 func NewM3uTaskCache(ctx context.Context, displayOpt *display.Display, cfg *task.Config, value []byte) (task.Task, error) {
-	return &Task{}, nil
+	var info struct {
+		Url string `json:"url"`
+		Dir string `json:"dir"`
+	}
+	if err := json.Unmarshal(value, &info); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(info.Url)
+	if err != nil || info.Url == "" {
+		return nil, fmt.Errorf("m3u task without a playlist url %q", info.Url)
+	}
+	t := NewM3uTask(ctx, displayOpt, cfg, u, info.Dir)
+	if t == nil {
+		return nil, fmt.Errorf("m3u task dir %s is not usable", info.Dir)
+	}
+	return t, nil
 }
 
 func NewM3uTask(ctx context.Context, displayOpt *display.Display, cfg *task.Config, url *url.URL, dir string) task.Task {
@@ -99,23 +125,101 @@ func NewM3uTask(ctx context.Context, displayOpt *display.Display, cfg *task.Conf
 		ctx:     ctx,
 		cancel:  cancel,
 		status:  atomic.Int32{},
-		tasks:   task.NewManager(ctx, cfg.ThreadSize, status),
 		Url:     url,
 		Dir:     dir,
 		display: displayOpt,
 		cfg:     *cfg,
-		info:    make(map[string]interface{}),
+		// enough for NewM3uTaskCache before the playlist is fetched
+		info:     map[string]interface{}{"url": url.String(), "dir": dir},
+		restored: make(map[string]bool),
 	}
+	t.renew = newRenewer(t, url, nil)
+	// the unfinished segments of an interrupted run continue once it starts
+	t.tasks = newSegmentManager(ctx, cfg, status, task.WithRebuild(t.restoreSegment))
 	t.status.Store(task.Pending)
 	return t
 }
 
+// segmentQueue is how many segments wait for a worker, the retries and the restored
+// segments are sorted in among them by their place in the playlist.
+const segmentQueue = 64
+
+// newSegmentManager runs the segments of a playlist, a failed segment runs again and
+// the playlist start is downloaded first.
+func newSegmentManager(ctx context.Context, cfg *task.Config, status string, opts ...task.ManagerOption) task.Manager {
+	retry := task.RetryPolicy{Attempts: int(cfg.TaskRetries) + 1, Backoff: time.Second, Retryable: download.Retryable}
+	opts = append([]task.ManagerOption{task.WithPolicy(task.PlaybackOrder), task.WithQueueSize(segmentQueue),
+		task.WithDefaultRetry(retry)}, opts...)
+	return task.NewManager(ctx, cfg.ThreadSize, status, opts...)
+}
+
+// queueSegment waits while the queue of the segments is full.
+func (t *Task) queueSegment(name string, job task.Task, opts ...task.TaskOption) error {
+	return t.tasks.WaitTask(t.ctx, name, job, opts...)
+}
+
+// keyLabel marks the key jobs in the status file.
+const keyLabel = "key"
+
+// newSegment sets up the job of a playlist entry, a key gets the index of the first
+// segment it decrypts.
+func (t *Task) newSegment(u *url.URL, name string, index int, sequence int64, key bool) *download.Job {
+	cfg := &t.cfg
+	if key {
+		keyCfg := t.cfg
+		keyCfg.Proxy = t.cfg.Proxy.ForKeys()
+		cfg = &keyCfg
+	}
+	job := download.NewHttpTask(t.ctx, u, filepath.Join(t.Dir, name), true, cfg, nil).(*download.Job)
+	job.SetSegment(index, sequence)
+	k := segmentKey{sequence, key}
+	job.SetRefresh(func(ctx context.Context, stale string) (string, error) {
+		return t.renew.renew(ctx, k, stale)
+	}, int(t.cfg.Refresh.Times))
+	return job
+}
+
+// restoreSegment rebuilds a segment of the status file with its playlist settings,
+// its progress is kept next to the file.
+func (t *Task) restoreSegment(info task.WorkInfo) (task.Task, error) {
+	var job download.JobInfo
+	if err := json.Unmarshal(info.Extra, &job); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(job.Url)
+	if err != nil || job.Url == "" {
+		return nil, fmt.Errorf("segment %s without a url", info.Name)
+	}
+	t.restored[info.Name] = true
+	return t.newSegment(u, info.Name, job.Index, job.Sequence, info.Label == keyLabel), nil
+}
+
+// completed lists the segments a previous run downloaded that are still on disk.
+func (t *Task) completed() map[string]bool {
+	done := make(map[string]bool)
+	infos, err := t.tasks.History()
+	if err != nil {
+		return done
+	}
+	for _, info := range infos {
+		if info.Status != task.Completed {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(t.Dir, info.Name)); err == nil {
+			done[info.Name] = true
+		}
+	}
+	return done
+}
+
 func (t *Task) Start() error {
 	var err error
 	defer func() {
 		if t.status.Load() == task.Running {
-			if err != nil {
+			if task.IsCancelled(err) {
 				t.status.Store(task.Aborted)
+			} else if err != nil {
+				t.status.Store(task.Failed)
 			} else {
 				t.status.Store(task.Completed)
 			}
@@ -123,28 +227,37 @@ func (t *Task) Start() error {
 	}()
 	t.status.Store(task.Running)
 	err = t.run()
+	if err == nil {
+		err = task.Cancelled(t.ctx)
+	}
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		t.lock.Lock()
+		t.info["failed"] = partial.Failed
+		t.lock.Unlock()
+	}
 	return err
 }
 
-func (t *Task) run() error {
-
+// fetchPlaylist downloads the playlist at u over the local copy and parses it.
+func (t *Task) fetchPlaylist(ctx context.Context, u *url.URL) (string, []Entry, error) {
 	filename := filepath.Base(t.Url.Path)
 
 	filename = filepath.Join(t.Dir, filename)
-	m3uJob := download.NewHttpTask(t.ctx, t.Url, filename, true, &t.cfg, t.display)
+	m3uJob := download.NewHttpTask(ctx, u, filename, true, &t.cfg, t.display)
 
 	err := m3uJob.Start()
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
-			log.Error("download failed", zap.Error(err), zap.String("url", t.Url.String()))
+			log.Error("download failed", zap.Error(err), zap.String("url", u.String()))
 		}
-		return err
+		return "", nil, err
 	}
-	log.Info("download success", zap.String("url", t.Url.String()))
+	log.Info("download success", zap.String("url", u.String()))
 	info, err := m3uJob.Extra()
 	if err != nil {
 		log.Error("get Extra from m3uJob ", zap.Error(err))
-		return err
+		return "", nil, err
 	}
 	var jobInfo download.JobInfo
 	err = json.Unmarshal(info, &jobInfo)
@@ -152,50 +265,157 @@ func (t *Task) run() error {
 		log.Error("unmarshal m3uJob info failed", zap.Error(err))
 	}
 	log.Info("start to check", zap.String("file", jobInfo.FileName))
+	entries, err := ParseM3u(jobInfo.FileName)
+	if err != nil {
+		log.Warn("it is not a m3u file", zap.Error(err))
+		return "", nil, err
+	}
+	return jobInfo.FileName, entries, nil
+}
+
+func (t *Task) run() error {
+	file, taskList, err := t.fetchPlaylist(t.ctx, t.Url)
+	if err != nil {
+		return err
+	}
 	{
 		t.lock.Lock()
 		defer t.lock.Unlock()
-		t.info["file"] = jobInfo.FileName
-		t.info["url"] = jobInfo.Url
+		t.info["file"] = file
+		t.info["url"] = t.Url.String()
 		t.info["dir"] = t.Dir
 	}
-	taskList, err := CheckIsM3u(jobInfo.FileName)
-	if err != nil {
-		log.Warn("it is not a m3u file", zap.Error(err))
-		return err
-	}
-
-	// 分割路径，找到最后一个斜杠的位置
-	pathParts := strings.Split(t.Url.Path, "/")
-	lastPartIndex := len(pathParts) - 1
-	newUrl := t.Url
-	defer t.tasks.Close()
 
 	var bar *mpb.Bar
 	if t.display != nil {
 		bar = t.display.AddBarCount(t.Dir, int64(len(taskList)), "down")
 	}
+	t.renew.mu.Lock()
+	t.renew.update(t.Url, taskList)
+	t.renew.mu.Unlock()
+	t.tasks.Restore()
+	t.segments.Store(int64(len(taskList)))
+	completed := t.completed()
 	curr := time.Now()
-	for _, jobName := range taskList {
-		pathParts[lastPartIndex] = jobName
-		newPath := strings.Join(pathParts, "/")
-		newUrl.Path = newPath
-
-		file := filepath.Join(t.Dir, jobName)
-		job := download.NewHttpTask(t.ctx, newUrl, file, true, &t.cfg, nil)
-
-		err = t.tasks.NewTask(jobName, job)
+	index := 0
+	for _, entry := range taskList {
+		if t.ctx.Err() != nil {
+			// the rest is left for the next run
+			break
+		}
+		newUrl, err := resolve(t.Url, entry.URI)
 		if err != nil {
-			log.Error("add new job failed", zap.Error(err))
+			log.Error("bad uri in playlist", zap.String("uri", entry.URI), zap.Error(err))
+			continue
+		}
+		// the signed query is not part of the file name
+		jobName := entry.URI
+		if i := strings.IndexAny(jobName, "?#"); i >= 0 {
+			jobName = jobName[:i]
+		}
+
+		opts := []task.TaskOption{task.WithOrder(int64(index))}
+		if entry.Key {
+			opts = append(opts, task.WithLabel(keyLabel))
+		}
+		segment := index
+		if !entry.Key {
+			index++
+		}
+		switch {
+		case t.restored[jobName]:
+			// queued by the manager already, it may have completed since
+		case completed[jobName]:
+			t.skipped.Add(1)
+		default:
+			job := t.newSegment(newUrl, jobName, segment, entry.Sequence, entry.Key)
+			if err = t.queueSegment(jobName, job, opts...); err != nil && !task.IsCancelled(err) {
+				log.Error("add new job failed", zap.Error(err))
+			}
 		}
 		dur := time.Since(curr)
 		display.InCr(bar, 1, dur)
 		curr = time.Now()
 	}
-	return nil
+	if err = t.tasks.Close(); err != nil {
+		log.Warn("close segment manager", zap.Error(err))
+	}
+	return segmentsResult(t.tasks.Results(), int(t.skipped.Load()))
+}
+
+// Segments returns how many entries of the playlist are done and failed for good,
+// total is 0 until the playlist is read. It is complete once Start returned.
+func (t *Task) Segments() (done, failed, total int) {
+	for _, r := range t.tasks.Results() {
+		switch r.Status {
+		case task.Completed:
+			done++
+		case task.Failed:
+			failed++
+		}
+	}
+	return done + int(t.skipped.Load()), failed, int(t.segments.Load())
+}
+
+// PartialError is a playlist whose segments did not all download after their retries,
+// Err is the error of the first failed segment.
+type PartialError struct {
+	Done   int
+	Failed []string
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d of %d segments failed, first: %v", len(e.Failed), e.Done+len(e.Failed), e.Err)
 }
 
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// segmentsResult is nil when no segment failed for good, skipped were completed by a
+// previous run.
+func segmentsResult(results []task.Result, skipped int) error {
+	partial := &PartialError{Done: skipped}
+	for _, r := range results {
+		switch r.Status {
+		case task.Completed:
+			partial.Done++
+		case task.Failed:
+			partial.Failed = append(partial.Failed, r.Name)
+			if partial.Err == nil {
+				partial.Err = r.Err
+			}
+		}
+	}
+	if len(partial.Failed) == 0 {
+		return nil
+	}
+	return partial
+}
+
+// Entry is a media segment or the key of the following segments.
+type Entry struct {
+	URI string
+	// Sequence is the media sequence number of the segment, or of the first segment using the key
+	Sequence int64
+	Key      bool
+}
+
+// CheckIsM3u returns the uris of the segments and keys in playlist order.
 func CheckIsM3u(filename string) ([]string, error) {
+	entries, err := ParseM3u(filename)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e.URI)
+	}
+	return list, nil
+}
+
+func ParseM3u(filename string) ([]Entry, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		log.Error("check is m3u , open failed ", zap.Error(err))
@@ -213,19 +433,31 @@ func CheckIsM3u(filename string) ([]string, error) {
 			return nil, errors.New("it is not a m3u file")
 		}
 	}
-	list := make([]string, 0)
+	list := make([]Entry, 0)
+	var seq int64
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") {
+			if n, err := strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64); err == nil {
+				seq = n
+			}
+			continue
+		}
 		// 检查是否是媒体文件的 URI 行
 		if !strings.HasPrefix(line, "#") {
-			list = append(list, line)
+			list = append(list, Entry{URI: line, Sequence: seq})
+			seq++
 		}
 		if strings.HasPrefix(line, "#EXT-X-KEY:") {
-			ts := GetKey(line)
-			list = append(list, ts)
+			if ts := GetKey(line); ts != "" {
+				list = append(list, Entry{URI: ts, Sequence: seq, Key: true})
+			}
 		}
 	}
-	return list, nil
+	return list, scanner.Err()
 }
 
 func GetKey(keyLine string) string {
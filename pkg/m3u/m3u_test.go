@@ -2,10 +2,23 @@ package m3u
 
 import (
 	"context"
+	"errors"
+	"github.com/chestnutsj/hls/pkg/download"
 	"github.com/chestnutsj/hls/pkg/log"
 	"github.com/chestnutsj/hls/pkg/task"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_m3u(t *testing.T) {
@@ -26,3 +39,247 @@ func Test_m3u(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_ParseM3u(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "index.m3u8")
+	content := `#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key1.key",IV=0x3b9d6e07420b308025d11a53692d8f51
+#EXTINF:10,
+a.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:10,
+b.ts
+`
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ParseM3u(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{URI: "key1.key", Sequence: 7, Key: true}, {URI: "a.ts", Sequence: 7}, {URI: "b.ts", Sequence: 8}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatal(entries)
+	}
+}
+
+func Test_M3u_RequestVars(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:10,\na.ts\n#EXTINF:10,\nb.ts\n#EXTINF:10,\nc.ts\n"
+	var mu sync.Mutex
+	seen := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[path.Base(r.URL.Path)] = r.Header.Get("X-Segment")
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			w.Write([]byte(playlist))
+			return
+		}
+		w.Write([]byte("segment"))
+	}))
+	defer server.Close()
+
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.Request.Headers = map[string]string{"X-Segment": "{{.Index}}/{{.Sequence}}"}
+	u, _ := url.Parse(server.URL + "/live/index.m3u8")
+	if err := NewM3uTask(context.Background(), nil, cfg, u, t.TempDir()).Start(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"index.m3u8": "0/0", "a.ts": "0/5", "b.ts": "1/6", "c.ts": "2/7"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatal(seen)
+	}
+}
+
+func Test_M3u_SegmentRetry(t *testing.T) {
+	playlist := "#EXTM3U\n#EXTINF:10,\na.ts\n#EXTINF:10,\nb.ts\n#EXTINF:10,\nc.ts\n"
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[path.Base(r.URL.Path)]++
+		n := hits[path.Base(r.URL.Path)]
+		mu.Unlock()
+		switch path.Base(r.URL.Path) {
+		case "index.m3u8":
+			w.Write([]byte(playlist))
+		case "b.ts":
+			http.NotFound(w, r)
+		case "c.ts":
+			if n == 1 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("segment"))
+		default:
+			w.Write([]byte("segment"))
+		}
+	}))
+	defer server.Close()
+
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	u, _ := url.Parse(server.URL + "/live/index.m3u8")
+	dir := t.TempDir()
+	mu.Lock()
+	first := make(map[string]int)
+	for k, v := range hits {
+		first[k] = v
+	}
+	mu.Unlock()
+	job := NewM3uTask(context.Background(), nil, cfg, u, dir).(*Task)
+	err := job.Start()
+	var partial *PartialError
+	if !errors.As(err, &partial) || partial.Done != 2 || !reflect.DeepEqual(partial.Failed, []string{"b.ts"}) {
+		t.Fatalf("%T %v", err, err)
+	}
+	if done, failed, total := job.Segments(); done != 2 || failed != 1 || total != 3 {
+		t.Fatal("segments", done, failed, total)
+	}
+	var status *download.StatusError
+	if !errors.As(err, &status) || status.Code != http.StatusNotFound {
+		t.Fatal("cause", err)
+	}
+	// a 404 is not retried, a 503 is
+	if hits["b.ts"] != 1 || hits["c.ts"] < 2 {
+		t.Fatal(hits)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "c.ts")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_M3u_Restore(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:10,\na.ts\n#EXTINF:10,\nb.ts\n#EXTINF:10,\nc.ts\n"
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	seen := make(map[string]string)
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		mu.Lock()
+		hits[name]++
+		n := hits[name]
+		seen[name] = r.Header.Get("X-Segment")
+		mu.Unlock()
+		switch {
+		case name == "index.m3u8":
+			w.Write([]byte(playlist))
+		case name == "b.ts" && n == 1:
+			// the first run is interrupted here
+			close(stalled)
+			<-r.Context().Done()
+		default:
+			w.Write([]byte("segment"))
+		}
+	}))
+	defer server.Close()
+
+	cfg := task.NewDownloadConfig()
+	cfg.RetryCount = 0
+	cfg.ThreadSize = 1
+	cfg.Request.Headers = map[string]string{"X-Segment": "{{.Index}}/{{.Sequence}}"}
+	u, _ := url.Parse(server.URL + "/live/index.m3u8")
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stalled
+		cancel()
+	}()
+	if err := NewM3uTask(ctx, nil, cfg, u, dir).Start(); !task.IsCancelled(err) {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	first := make(map[string]int)
+	for k, v := range hits {
+		first[k] = v
+	}
+	mu.Unlock()
+	// a task that is built but not started downloads nothing
+	idle := NewM3uTask(context.Background(), nil, cfg, u, dir).(*Task)
+	if !idle.restored["b.ts"] {
+		t.Fatal("b.ts is not restored", idle.restored)
+	}
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	if hits["b.ts"] != first["b.ts"] || hits["index.m3u8"] != first["index.m3u8"] {
+		mu.Unlock()
+		t.Fatal("requests before Start", hits)
+	}
+	mu.Unlock()
+	_ = idle.Exit()
+
+	job := NewM3uTask(context.Background(), nil, cfg, u, dir).(*Task)
+	if !job.restored["b.ts"] {
+		t.Fatal("b.ts is not restored", job.restored)
+	}
+	if err := job.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if done, failed, total := job.Segments(); done != 3 || failed != 0 || total != 3 {
+		t.Fatal("segments", done, failed, total)
+	}
+	// a.ts is not fetched again, the restored b.ts keeps its place in the playlist
+	if hits["a.ts"] != first["a.ts"] || hits["b.ts"] <= first["b.ts"] || hits["c.ts"] == 0 {
+		t.Fatal(hits)
+	}
+	if seen["b.ts"] != "1/6" {
+		t.Fatal("restored segment vars", seen["b.ts"])
+	}
+	for _, name := range []string{"a.ts", "b.ts", "c.ts"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// orderJob calls run when it starts.
+type orderJob struct {
+	status atomic.Int32
+	run    func()
+}
+
+func (j *orderJob) GetStatus() task.Status { return j.status.Load() }
+func (j *orderJob) Stop() error            { return nil }
+func (j *orderJob) Resume() error          { return nil }
+func (j *orderJob) Exit() error            { return nil }
+func (j *orderJob) Extra() ([]byte, error) { return []byte("{}"), nil }
+func (j *orderJob) GetType() string        { return "order" }
+func (j *orderJob) Start() error {
+	j.run()
+	j.status.Store(task.Completed)
+	return nil
+}
+
+func Test_M3u_PlaybackOrder(t *testing.T) {
+	cfg := task.NewDownloadConfig()
+	cfg.ThreadSize = 1
+	mgr := newSegmentManager(context.Background(), cfg, filepath.Join(t.TempDir(), "m3u.cache"))
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var ran []int
+	// the only worker is busy while the segments are queued out of order
+	if err := mgr.NewTask("first", &orderJob{run: func() { <-release }}, task.WithOrder(0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{4, 2, 5, 1, 3} {
+		job := &orderJob{run: func() {
+			mu.Lock()
+			ran = append(ran, i)
+			mu.Unlock()
+		}}
+		if err := mgr.NewTask(strconv.Itoa(i), job, task.WithOrder(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	if err := mgr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []int{1, 2, 3, 4, 5}) {
+		t.Fatal(ran)
+	}
+}
@@ -0,0 +1,130 @@
+package m3u
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/chestnutsj/hls/pkg/log"
+	"go.uber.org/zap"
+)
+
+// Refresher returns a playlist url with fresh tokens, current is the one in use.
+type Refresher func(ctx context.Context, current *url.URL) (*url.URL, error)
+
+var (
+	refresherLock sync.RWMutex
+	refreshers    = map[string]Refresher{}
+)
+
+// RegisterRefresher makes f the refresher of RefreshConfig.Hook name.
+func RegisterRefresher(name string, f Refresher) {
+	refresherLock.Lock()
+	defer refresherLock.Unlock()
+	refreshers[name] = f
+}
+
+// segmentKey finds an entry in a newer playlist.
+type segmentKey struct {
+	sequence int64
+	key      bool
+}
+
+// renewer maps the segments to their urls in the newest playlist, the segments refused
+// at the same time share one refresh.
+type renewer struct {
+	t        *Task
+	mu       sync.Mutex
+	playlist *url.URL
+	urls     map[segmentKey]string
+}
+
+func newRenewer(t *Task, playlist *url.URL, entries []Entry) *renewer {
+	r := &renewer{t: t}
+	r.update(playlist, entries)
+	return r
+}
+
+func (r *renewer) update(playlist *url.URL, entries []Entry) {
+	r.playlist = playlist
+	r.urls = make(map[segmentKey]string, len(entries))
+	for _, e := range entries {
+		if u, err := resolve(playlist, e.URI); err == nil {
+			r.urls[segmentKey{e.Sequence, e.Key}] = u.String()
+		}
+	}
+}
+
+// renew returns the url of the entry refused at stale.
+func (r *renewer) renew(ctx context.Context, k segmentKey, stale string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.urls[k]; ok && u != stale {
+		// another segment refreshed the playlist already
+		return u, nil
+	}
+	playlist, err := r.newPlaylist(ctx)
+	if err != nil {
+		return "", err
+	}
+	_, entries, err := r.t.fetchPlaylist(ctx, playlist)
+	if err != nil {
+		return "", err
+	}
+	r.update(playlist, entries)
+	u, ok := r.urls[k]
+	if !ok {
+		return "", fmt.Errorf("sequence %d is no longer in the playlist", k.sequence)
+	}
+	log.Info("playlist refreshed", zap.String("playlist", playlist.Redacted()), zap.Int64("sequence", k.sequence))
+	return u, nil
+}
+
+// newPlaylist asks the hook or the command for the playlist url, the current one is
+// fetched again without them.
+func (r *renewer) newPlaylist(ctx context.Context) (*url.URL, error) {
+	cfg := r.t.cfg.Refresh
+	if cfg.Hook != "" {
+		refresherLock.RLock()
+		f := refreshers[cfg.Hook]
+		refresherLock.RUnlock()
+		if f == nil {
+			return nil, fmt.Errorf("unknown refresh hook %q", cfg.Hook)
+		}
+		return f(ctx, r.playlist)
+	}
+	if cfg.Command == "" {
+		return r.playlist, nil
+	}
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	cmd := exec.CommandContext(ctx, shell, flag, cfg.Command)
+	cmd.Env = append(os.Environ(), "HLS_PLAYLIST_URL="+r.playlist.String())
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("refresh command: %w", err)
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	u, err := url.Parse(strings.TrimSpace(line))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("refresh command printed %q, want a url", line)
+	}
+	return u, nil
+}
+
+// resolve returns the url of a playlist entry.
+func resolve(playlist *url.URL, uri string) (*url.URL, error) {
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	return playlist.ResolveReference(ref), nil
+}
@@ -0,0 +1,103 @@
+package m3u
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/task"
+)
+
+// tokenServer signs the segment of its playlist with a token that expires after
+// expireAfter ranged requests, /old/index.m3u8 is refused once it expired.
+type tokenServer struct {
+	mu          sync.Mutex
+	token       int
+	served      int
+	expireAfter int
+	// starts are the range starts asked after the first expiry
+	starts []int64
+	data   []byte
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasSuffix(r.URL.Path, ".m3u8") {
+		if r.URL.Path == "/old/index.m3u8" && s.token > 1 {
+			http.Error(w, "playlist moved", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:3\n#EXTINF:10,\nseg.ts?token=%d\n", s.token)
+		return
+	}
+	if r.URL.Query().Get("token") != fmt.Sprint(s.token) {
+		http.Error(w, "expired", http.StatusForbidden)
+		return
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		if s.token > 1 {
+			var start int64
+			fmt.Sscanf(rng, "bytes=%d-", &start)
+			s.starts = append(s.starts, start)
+		}
+		s.served++
+		if s.served == s.expireAfter {
+			s.token++
+		}
+	}
+	http.ServeContent(w, r, "seg.ts", time.Time{}, bytes.NewReader(s.data))
+}
+
+func Test_M3u_Refresh(t *testing.T) {
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, c := range []struct {
+		name     string
+		playlist string
+		command  string
+	}{
+		{"playlist", "/live/index.m3u8", ""},
+		{"command", "/old/index.m3u8", "echo $HLS_PLAYLIST_URL | sed s/old/new/"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ts := &tokenServer{token: 1, expireAfter: 3, data: data}
+			server := httptest.NewServer(ts)
+			defer server.Close()
+
+			cfg := task.NewDownloadConfig()
+			cfg.RetryCount = 0
+			cfg.ChunkSize = 50000
+			cfg.ThreadSize = 2
+			cfg.Refresh = task.RefreshConfig{Times: 2, Command: c.command}
+			dir := t.TempDir()
+			u, _ := url.Parse(server.URL + c.playlist)
+			if err := NewM3uTask(context.Background(), nil, cfg, u, dir).Start(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "seg.ts"))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatal("segment differs", len(got), err)
+			}
+			if len(ts.starts) == 0 {
+				t.Fatal("token did not expire")
+			}
+			for _, start := range ts.starts {
+				if start < 150000 {
+					t.Fatal("progress lost, range from", start)
+				}
+			}
+		})
+	}
+}
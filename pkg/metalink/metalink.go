@@ -0,0 +1,215 @@
+package metalink
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**
+metalink 4 (RFC 5854, .meta4) and metalink 3 (.metalink) descriptions of files,
+their mirrors and checksums.
+*/
+
+type URL struct {
+	URL      string
+	Priority int // lower is better
+	Location string
+}
+
+type File struct {
+	Name        string
+	Size        int64
+	Hashes      map[string]string // normalized type, e.g. "sha-256" -> hex
+	PieceType   string
+	PieceLength int64
+	Pieces      []string
+	URLs        []URL
+}
+
+type Metalink struct {
+	Files []File
+}
+
+// metalink 4
+type v4Hash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type v4Pieces struct {
+	Length int64    `xml:"length,attr"`
+	Type   string   `xml:"type,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type v4URL struct {
+	Priority int    `xml:"priority,attr"`
+	Location string `xml:"location,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type v4File struct {
+	Name   string     `xml:"name,attr"`
+	Size   int64      `xml:"size"`
+	Hashes []v4Hash   `xml:"hash"`
+	Pieces []v4Pieces `xml:"pieces"`
+	URLs   []v4URL    `xml:"url"`
+}
+
+// metalink 3
+type v3Piece struct {
+	Piece int    `xml:"piece,attr"`
+	Value string `xml:",chardata"`
+}
+
+type v3Pieces struct {
+	Length int64     `xml:"length,attr"`
+	Type   string    `xml:"type,attr"`
+	Hashes []v3Piece `xml:"hash"`
+}
+
+type v3URL struct {
+	Type       string `xml:"type,attr"`
+	Location   string `xml:"location,attr"`
+	Preference int    `xml:"preference,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type v3File struct {
+	Name         string `xml:"name,attr"`
+	Size         int64  `xml:"size"`
+	Verification struct {
+		Hashes []v4Hash   `xml:"hash"`
+		Pieces []v3Pieces `xml:"pieces"`
+	} `xml:"verification"`
+	Resources struct {
+		URLs []v3URL `xml:"url"`
+	} `xml:"resources"`
+}
+
+type document struct {
+	XMLName xml.Name
+	Version string   `xml:"version,attr"`
+	V4Files []v4File `xml:"file"`
+	V3Files []v3File `xml:"files>file"`
+}
+
+var ErrNoFile = errors.New("metalink has no file")
+
+// NormalizeHash maps the hash names of both versions to the IANA names used by metalink 4.
+func NormalizeHash(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "sha1":
+		return "sha-1"
+	case "sha256":
+		return "sha-256"
+	case "sha384":
+		return "sha-384"
+	case "sha512":
+		return "sha-512"
+	}
+	return name
+}
+
+func Parse(r io.Reader) (*Metalink, error) {
+	var doc document
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.XMLName.Local != "metalink" {
+		return nil, errors.New("it is not a metalink file")
+	}
+	m := &Metalink{}
+	for _, f := range doc.V4Files {
+		file := File{Name: f.Name, Size: f.Size, Hashes: make(map[string]string)}
+		for _, h := range f.Hashes {
+			file.Hashes[NormalizeHash(h.Type)] = strings.ToLower(strings.TrimSpace(h.Value))
+		}
+		if len(f.Pieces) > 0 {
+			p := f.Pieces[0]
+			file.PieceType = NormalizeHash(p.Type)
+			file.PieceLength = p.Length
+			for _, h := range p.Hashes {
+				file.Pieces = append(file.Pieces, strings.ToLower(strings.TrimSpace(h)))
+			}
+		}
+		for _, u := range f.URLs {
+			priority := u.Priority
+			if priority == 0 {
+				// RFC 5854: priority 1 is the highest, no priority is the lowest
+				priority = 999999
+			}
+			file.URLs = append(file.URLs, URL{URL: strings.TrimSpace(u.Value), Priority: priority, Location: strings.ToLower(u.Location)})
+		}
+		m.Files = append(m.Files, file)
+	}
+	for _, f := range doc.V3Files {
+		file := File{Name: f.Name, Size: f.Size, Hashes: make(map[string]string)}
+		for _, h := range f.Verification.Hashes {
+			file.Hashes[NormalizeHash(h.Type)] = strings.ToLower(strings.TrimSpace(h.Value))
+		}
+		if len(f.Verification.Pieces) > 0 {
+			p := f.Verification.Pieces[0]
+			file.PieceType = NormalizeHash(p.Type)
+			file.PieceLength = p.Length
+			sort.SliceStable(p.Hashes, func(i, j int) bool { return p.Hashes[i].Piece < p.Hashes[j].Piece })
+			for _, h := range p.Hashes {
+				file.Pieces = append(file.Pieces, strings.ToLower(strings.TrimSpace(h.Value)))
+			}
+		}
+		for _, u := range f.Resources.URLs {
+			if u.Type != "" && u.Type != "http" && u.Type != "https" && u.Type != "ftp" {
+				continue
+			}
+			// metalink 3 preference is 100 for the best, turn it into a priority
+			file.URLs = append(file.URLs, URL{URL: strings.TrimSpace(u.Value), Priority: 101 - u.Preference, Location: strings.ToLower(u.Location)})
+		}
+		m.Files = append(m.Files, file)
+	}
+	if len(m.Files) == 0 {
+		return nil, ErrNoFile
+	}
+	for i := range m.Files {
+		m.Files[i].SortURLs()
+	}
+	return m, nil
+}
+
+func ParseFile(name string) (*Metalink, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// IsMetalink tells from the file name whether it should be parsed as a metalink.
+func IsMetalink(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".meta4") || strings.HasSuffix(name, ".metalink")
+}
+
+// SortURLs orders the urls by priority, urls in one of the preferred locations go first.
+func (f *File) SortURLs(locations ...string) {
+	preferred := func(u URL) bool {
+		for _, l := range locations {
+			if strings.EqualFold(l, u.Location) {
+				return true
+			}
+		}
+		return false
+	}
+	sort.SliceStable(f.URLs, func(i, j int) bool {
+		pi, pj := preferred(f.URLs[i]), preferred(f.URLs[j])
+		if pi != pj {
+			return pi
+		}
+		return f.URLs[i].Priority < f.URLs[j].Priority
+	})
+}
@@ -0,0 +1,96 @@
+package metalink
+
+import (
+	"strings"
+	"testing"
+)
+
+const meta4 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="example.ext">
+    <size>14471447</size>
+    <hash type="sha-256">F0AD929CD259957E160EA442EB80986B5F01</hash>
+    <pieces length="262144" type="sha-1">
+      <hash>aaa</hash>
+      <hash>bbb</hash>
+    </pieces>
+    <url location="de" priority="2">ftp://ftp.example.com/example.ext</url>
+    <url location="fr" priority="1">http://example.com/example.ext</url>
+    <url location="jp">http://example.jp/example.ext</url>
+  </file>
+</metalink>`
+
+const metalink3 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.ext">
+      <size>1000</size>
+      <verification>
+        <hash type="md5">abc</hash>
+        <hash type="sha256">def</hash>
+        <pieces length="500" type="sha1">
+          <hash piece="1">second</hash>
+          <hash piece="0">first</hash>
+        </pieces>
+      </verification>
+      <resources>
+        <url type="http" location="us" preference="50">http://us.example.com/example.ext</url>
+        <url type="http" location="de" preference="100">http://de.example.com/example.ext</url>
+        <url type="bittorrent" preference="100">http://example.com/example.torrent</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+func Test_meta4(t *testing.T) {
+	m, err := Parse(strings.NewReader(meta4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.Files[0]
+	if f.Name != "example.ext" || f.Size != 14471447 {
+		t.Fatal("wrong file", f.Name, f.Size)
+	}
+	if f.Hashes["sha-256"] != "f0ad929cd259957e160ea442eb80986b5f01" {
+		t.Fatal("wrong hash", f.Hashes)
+	}
+	if f.PieceType != "sha-1" || f.PieceLength != 262144 || len(f.Pieces) != 2 {
+		t.Fatal("wrong pieces", f.PieceType, f.PieceLength, f.Pieces)
+	}
+	want := []string{"http://example.com/example.ext", "ftp://ftp.example.com/example.ext", "http://example.jp/example.ext"}
+	for i, u := range want {
+		if f.URLs[i].URL != u {
+			t.Fatal("wrong order", f.URLs)
+		}
+	}
+	f.SortURLs("jp")
+	if f.URLs[0].Location != "jp" {
+		t.Fatal("location not preferred", f.URLs)
+	}
+}
+
+func Test_metalink3(t *testing.T) {
+	m, err := Parse(strings.NewReader(metalink3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.Files[0]
+	if f.Size != 1000 || f.Hashes["md5"] != "abc" || f.Hashes["sha-256"] != "def" {
+		t.Fatal("wrong file", f)
+	}
+	if f.PieceType != "sha-1" || len(f.Pieces) != 2 || f.Pieces[0] != "first" {
+		t.Fatal("wrong pieces", f.Pieces)
+	}
+	if len(f.URLs) != 2 || f.URLs[0].Location != "de" {
+		t.Fatal("wrong urls", f.URLs)
+	}
+}
+
+func Test_notMetalink(t *testing.T) {
+	if _, err := Parse(strings.NewReader("<html></html>")); err == nil {
+		t.Fatal("want error")
+	}
+	if !IsMetalink("a/b.META4") || IsMetalink("a.m3u8") {
+		t.Fatal("wrong name check")
+	}
+}
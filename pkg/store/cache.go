@@ -156,39 +156,52 @@ func (l *Log) truncate() {
 	_ = l.file.Truncate(0)
 }
 
+// Close syncs the records so a status file left by a shutdown is complete.
 func (l *Log) Close() error {
 	var err error
 	l.Do(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		_ = l.file.Sync()
 		err = l.file.Close()
 	})
 	return err
 }
 
+// initCache rebuilds the index. A record torn by a crash at the end of the file is cut off.
 func (l *Log) initCache() (KeyVal, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
 	_, err := l.file.Seek(0, io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
+	info, err := l.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
 	kv := make(KeyVal)
+	// end of the last complete record
+	good := int64(0)
 
 	for {
-		keyLenBytes := make([]byte, 4)
-		if _, err := io.ReadFull(l.file, keyLenBytes); err != nil {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(l.file, header); err != nil {
 			if err == io.EOF {
 				break
 			}
+			if err == io.ErrUnexpectedEOF {
+				return kv, l.cut(good)
+			}
 			return nil, err
 		}
-		keyLen := binary.BigEndian.Uint32(keyLenBytes)
-
-		valueLenBytes := make([]byte, 4)
-		if _, err := io.ReadFull(l.file, valueLenBytes); err != nil {
-			return nil, err
+		keyLen := binary.BigEndian.Uint32(header[:4])
+		valueLen := binary.BigEndian.Uint32(header[4:])
+		if good+8+int64(keyLen)+int64(valueLen) > size {
+			return kv, l.cut(good)
 		}
-		valueLen := binary.BigEndian.Uint32(valueLenBytes)
 
 		key := make([]byte, keyLen)
 		if _, err := io.ReadFull(l.file, key); err != nil {
@@ -201,10 +214,15 @@ func (l *Log) initCache() (KeyVal, error) {
 				return nil, err
 			}
 		}
+		good = pos + int64(valueLen)
 	}
 	return kv, nil
 }
 
+func (l *Log) cut(size int64) error {
+	return l.file.Truncate(size)
+}
+
 func (l *Log) readValue(pos int64, len uint32) ([]byte, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
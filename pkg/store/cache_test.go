@@ -98,3 +98,46 @@ func Test_decode(t *testing.T) {
 	println(hex.Dump(buf.Bytes()))
 
 }
+
+func Test_tornRecord(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "torn.db")
+	bc, err := NewBitCask(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = bc.Set("a", []byte("value1"))
+	_ = bc.Set("b", []byte("value2"))
+	_ = bc.Close()
+
+	info, err := os.Stat(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash in the middle of the second record
+	if err = os.Truncate(db, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	bc, err = NewBitCask(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := bc.Get("a"); err != nil || string(v) != "value1" {
+		t.Fatal("lost the complete record", string(v), err)
+	}
+	if _, err = bc.Get("b"); err != NotFound {
+		t.Fatal("torn record should be dropped", err)
+	}
+	// new records go after the last complete one
+	_ = bc.Set("c", []byte("value3"))
+	_ = bc.Close()
+
+	bc, err = NewBitCask(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if v, err := bc.Get("c"); err != nil || string(v) != "value3" {
+		t.Fatal("record after recovery lost", string(v), err)
+	}
+}
@@ -0,0 +1,58 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ValidationError is a config or an input a task can't start with.
+type ValidationError struct {
+	// Field names the config key or the input, e.g. proxy or url
+	Field string
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Field, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Invalid wraps err in a ValidationError of field, nil stays nil.
+func Invalid(field string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ValidationError{Field: field, Err: err}
+}
+
+// CancelledError is a task stopped by its context before it finished, Err is the
+// context error so errors.Is(err, context.Canceled) still holds.
+type CancelledError struct {
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("cancelled: %v", e.Err)
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// Cancelled returns the CancelledError of ctx, nil while ctx is not done.
+func Cancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &CancelledError{Err: err}
+	}
+	return nil
+}
+
+// IsCancelled reports whether err is a cancellation, typed or a bare context error.
+func IsCancelled(err error) bool {
+	var ce *CancelledError
+	return errors.As(err, &ce) || errors.Is(err, context.Canceled)
+}
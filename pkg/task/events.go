@@ -0,0 +1,302 @@
+package task
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is what happened to a task.
+type EventType int
+
+const (
+	EventQueued EventType = iota
+	EventStarted
+	EventProgress
+	EventPaused
+	EventResumed
+	EventCompleted
+	EventFailed
+	EventAborted
+	EventRetried
+	// EventLagged is the last event of a subscriber that fell subscriberQueue events
+	// behind, nothing is delivered to it afterwards
+	EventLagged
+)
+
+// subscriberQueue bounds the undelivered events of a subscriber.
+const subscriberQueue = 1024
+
+var eventNames = map[EventType]string{
+	EventQueued:    "queued",
+	EventStarted:   "started",
+	EventProgress:  "progress",
+	EventPaused:    "paused",
+	EventResumed:   "resumed",
+	EventCompleted: "completed",
+	EventFailed:    "failed",
+	EventAborted:   "aborted",
+	EventRetried:   "retried",
+	EventLagged:    "lagged",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+// Event is published by the manager for every change of a task.
+type Event struct {
+	Type EventType
+	Name string
+	Time time.Time
+	// Attempt is the run of the task, 1 for the first
+	Attempt int
+	// Bytes, Total and Rate are set on progress, Total is 0 while the size is unknown
+	Bytes int64
+	Total int64
+	// Rate is bytes per second since the previous progress of the task
+	Rate int64
+	// Err is why the run failed, set on failed, aborted and retried
+	Err error
+}
+
+// Reporter is a task that tells how far it is, the manager publishes it as progress.
+type Reporter interface {
+	Transferred() (done, total int64)
+}
+
+// WithProgressInterval is how often the progress of the running tasks is published,
+// one second by default.
+func WithProgressInterval(d time.Duration) ManagerOption {
+	return func(m *manager) {
+		m.progressEvery = d
+	}
+}
+
+// bus hands the events to the subscribers, each one is fed by its own goroutine so a
+// slow subscriber never blocks the manager.
+type bus struct {
+	mu     sync.Mutex
+	subs   map[int]*subscriber
+	next   int
+	closed bool
+}
+
+// subscriber queues the events not delivered yet. The lifecycle events are kept, a
+// progress event replaces the undelivered progress of the same task. A full queue ends
+// with EventLagged and the subscriber is dropped.
+type subscriber struct {
+	f      func(Event)
+	mu     sync.Mutex
+	queue  []Event
+	latest map[string]int
+	closed bool
+	wake   chan struct{}
+	stop   chan struct{}
+	exited chan struct{}
+}
+
+func (b *bus) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+func (b *bus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, s := range b.subs {
+		if !s.push(e) {
+			delete(b.subs, id)
+		}
+	}
+}
+
+// subscribe calls f with every event in order until the returned cancel, which waits
+// until f returned. onExit runs once no more events follow.
+func (b *bus) subscribe(f func(Event), onExit func()) func() {
+	s := &subscriber{
+		f:      f,
+		latest: make(map[string]int),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		if onExit != nil {
+			onExit()
+		}
+		return func() {}
+	}
+	id := b.next
+	b.next++
+	if b.subs == nil {
+		b.subs = make(map[int]*subscriber)
+	}
+	b.subs[id] = s
+	b.mu.Unlock()
+
+	go func() {
+		defer close(s.exited)
+		if onExit != nil {
+			defer onExit()
+		}
+		s.run()
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(s.stop)
+			<-s.exited
+		})
+	}
+}
+
+// close lets every subscriber deliver what it queued and exit.
+func (b *bus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for id, s := range b.subs {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		s.signal()
+		delete(b.subs, id)
+	}
+}
+
+func (s *subscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push queues e, false when the subscriber lagged and is done.
+func (s *subscriber) push(e Event) bool {
+	s.mu.Lock()
+	keep := true
+	switch i, ok := s.latest[e.Name]; {
+	case s.closed:
+		keep = false
+	case ok && e.Type == EventProgress:
+		s.queue[i] = e
+	case len(s.queue) >= subscriberQueue:
+		s.queue = append(s.queue, Event{Type: EventLagged, Time: e.Time})
+		s.closed = true
+		keep = false
+	default:
+		if e.Type == EventProgress {
+			s.latest[e.Name] = len(s.queue)
+		}
+		s.queue = append(s.queue, e)
+	}
+	s.mu.Unlock()
+	s.signal()
+	return keep
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+		s.mu.Lock()
+		events, closed := s.queue, s.closed
+		s.queue = nil
+		s.latest = make(map[string]int)
+		s.mu.Unlock()
+		for _, e := range events {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			s.f(e)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// Subscribe calls f with the events of the manager in order from one goroutine, f must
+// not call the returned cancel. A subscriber too slow to keep up gets EventLagged last.
+func (m *manager) Subscribe(f func(Event)) (cancel func()) {
+	return m.events.subscribe(f, nil)
+}
+
+// Events returns the events on a channel of buffer events, it is closed after cancel,
+// after EventLagged or once the manager is closed and the queued events are read.
+func (m *manager) Events(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	done := make(chan struct{})
+	cancel := m.events.subscribe(func(e Event) {
+		select {
+		case ch <- e:
+		case <-done:
+		}
+	}, func() { close(ch) })
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+}
+
+// sample publishes the progress of the running reporters until the manager closes.
+func (m *manager) sample() {
+	every := m.progressEvery
+	if every <= 0 {
+		every = time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	type mark struct {
+		bytes int64
+		at    time.Time
+	}
+	last := make(map[string]mark)
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.sampling:
+			return
+		}
+		if !m.events.active() {
+			continue
+		}
+		now := time.Now()
+		seen := make(map[string]mark)
+		for _, name := range m.tasks.Keys() {
+			v, ok := m.tasks.Get(name)
+			if !ok {
+				continue
+			}
+			r, ok := v.(Reporter)
+			if !ok || v.(Task).GetStatus() != Running {
+				continue
+			}
+			done, total := r.Transferred()
+			e := Event{Type: EventProgress, Name: name, Time: now, Bytes: done, Total: total}
+			if prev, ok := last[name]; ok && now.After(prev.at) && done >= prev.bytes {
+				e.Rate = int64(float64(done-prev.bytes) / now.Sub(prev.at).Seconds())
+			}
+			seen[name] = mark{done, now}
+			m.events.publish(e)
+		}
+		last = seen
+	}
+}
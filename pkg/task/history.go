@@ -0,0 +1,147 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/chestnutsj/hls/pkg/display"
+	"github.com/chestnutsj/hls/pkg/log"
+	"go.uber.org/zap"
+)
+
+type restoreConfig struct {
+	display *display.Display
+	cfg     *Config
+	rebuild func(info WorkInfo) (Task, error)
+}
+
+// WithRestore makes the queue durable: the unfinished tasks of the status file are
+// rebuilt with NewTaskMap and queued again in their original order, and the file is
+// kept on Close as the history.
+func WithRestore(displayOpt *display.Display, cfg *Config) ManagerOption {
+	return func(m *manager) {
+		if m.restore == nil {
+			m.restore = &restoreConfig{}
+		}
+		m.restore.display, m.restore.cfg = displayOpt, cfg
+	}
+}
+
+// WithRebuild restores like WithRestore but rebuilds the tasks with f, for an owner
+// that sets its tasks up itself, e.g. the segments of a playlist. They are queued by
+// Restore, a manager that is never started does not run them.
+func WithRebuild(f func(info WorkInfo) (Task, error)) ManagerOption {
+	return func(m *manager) {
+		if m.restore == nil {
+			m.restore = &restoreConfig{}
+		}
+		m.restore.rebuild = f
+	}
+}
+
+// unfinished reports whether a recorded task should run again, an aborted task was
+// stopped by a shutdown and a failed one gave up.
+func unfinished(s Status) bool {
+	return s != Completed && s != Failed
+}
+
+// History lists the tasks recorded in the status file by queue order.
+func (m *manager) History() ([]WorkInfo, error) {
+	if m.cache == nil {
+		return nil, errors.New("manager has no status file")
+	}
+	var infos []WorkInfo
+	err := m.cache.Fetch(func(key string, value []byte) bool {
+		var info WorkInfo
+		if json.Unmarshal(value, &info) == nil {
+			info.Name = key
+			infos = append(infos, info)
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].Seq != infos[j].Seq {
+			return infos[i].Seq < infos[j].Seq
+		}
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos, nil
+}
+
+// load continues the sequence of the status file and rebuilds its unfinished tasks
+// when the manager restores.
+func (m *manager) load() []*worker {
+	infos, err := m.History()
+	if err != nil || len(infos) == 0 {
+		return nil
+	}
+	m.seq.Store(infos[len(infos)-1].Seq)
+	if m.restore == nil {
+		return nil
+	}
+	var restored []*worker
+	for _, info := range infos {
+		if !unfinished(info.Status) {
+			continue
+		}
+		t, err := m.rebuild(info)
+		if err != nil {
+			log.Error("restore task failed", zap.String("name", info.Name), zap.Error(err))
+			info.Status = Failed
+			info.Finished = time.Now()
+			info.Error = err.Error()
+			b, _ := json.Marshal(info)
+			_ = m.cache.Set(info.Name, b)
+			continue
+		}
+		log.Info("restore task", zap.String("name", info.Name), zap.String("type", info.Type))
+		m.tasks.Set(info.Name, t)
+		info.Status = t.GetStatus()
+		info.Started, info.Finished, info.Error = time.Time{}, time.Time{}, ""
+		restored = append(restored, &worker{key: info.Name, t: t, info: info})
+	}
+	return restored
+}
+
+// queueRestored queues the restored tasks ahead of the new ones.
+func (m *manager) queueRestored(restored []*worker) {
+	for _, w := range restored {
+		m.active.Add(1)
+		_ = m.queue.push(w, true, nil)
+	}
+}
+
+func (m *manager) Restore() {
+	m.mutex.Lock()
+	held := m.held
+	m.held = nil
+	m.mutex.Unlock()
+	m.queueRestored(held)
+}
+
+func (m *manager) rebuild(info WorkInfo) (Task, error) {
+	var t Task
+	var err error
+	if m.restore.rebuild != nil {
+		t, err = m.restore.rebuild(info)
+	} else {
+		newTask, ok := NewTaskMap[info.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown task type %q", info.Type)
+		}
+		t, err = newTask(m.ctx, m.restore.display, m.restore.cfg, info.Extra)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, fmt.Errorf("task type %q restored nothing", info.Type)
+	}
+	return t, nil
+}
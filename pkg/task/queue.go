@@ -0,0 +1,246 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Priority orders the queued tasks, a higher priority runs first.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// Policy orders the queued tasks of the same priority.
+type Policy int
+
+const (
+	// FIFO runs the tasks in the order they were added
+	FIFO Policy = iota
+	// PlaybackOrder runs the lower Order first, the segments of a playlist become usable
+	// from its start while the rest is downloading
+	PlaybackOrder
+)
+
+var (
+	// ErrQueueFull is returned by NewTask when the bounded queue of WithQueueSize is full.
+	ErrQueueFull = errors.New("task queue is full")
+	// ErrClosed is returned by NewTask after Close.
+	ErrClosed = errors.New("task manager is closed")
+)
+
+// TaskOption configures a task added by NewTask.
+type TaskOption func(*WorkInfo)
+
+// WithPriority queues the task ahead of the lower priorities.
+func WithPriority(p Priority) TaskOption {
+	return func(info *WorkInfo) {
+		info.Priority = p
+	}
+}
+
+// WithOrder places the task for the PlaybackOrder policy, e.g. the index of a segment.
+func WithOrder(order int64) TaskOption {
+	return func(info *WorkInfo) {
+		info.Order = order
+	}
+}
+
+// WithLabel records label with the task, see WorkInfo.Label.
+func WithLabel(label string) TaskOption {
+	return func(info *WorkInfo) {
+		info.Label = label
+	}
+}
+
+// WithQueueSize bounds the queue to size waiting tasks, NewTask fails with ErrQueueFull
+// instead of waiting and WaitTask waits for room. Without it they return once a worker
+// took the task.
+func WithQueueSize(size int) ManagerOption {
+	return func(m *manager) {
+		m.queue.size = size
+	}
+}
+
+// WithPolicy orders the tasks of one priority, FIFO by default.
+func WithPolicy(p Policy) ManagerOption {
+	return func(m *manager) {
+		m.queue.policy = p
+	}
+}
+
+// queue holds the tasks no worker took yet, sorted in the order they run.
+type queue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []*worker
+	size   int
+	policy Policy
+	closed bool
+	// quit is the number of workers Resize asked to exit
+	quit int
+	// room is closed and replaced when a queued task leaves
+	room chan struct{}
+}
+
+func newQueue() *queue {
+	q := &queue{room: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// freed wakes the pushes waiting for room, the lock is held.
+func (q *queue) freed() {
+	close(q.room)
+	q.room = make(chan struct{})
+}
+
+func (q *queue) less(a, b *worker) bool {
+	if a.info.Priority != b.info.Priority {
+		return a.info.Priority > b.info.Priority
+	}
+	if q.policy == PlaybackOrder && a.info.Order != b.info.Order {
+		return a.info.Order < b.info.Order
+	}
+	return a.info.Seq < b.info.Seq
+}
+
+// insert keeps the items sorted, the lock is held.
+func (q *queue) insert(w *worker) {
+	i := sort.Search(len(q.items), func(i int) bool {
+		return q.less(w, q.items[i])
+	})
+	q.items = append(q.items, nil)
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = w
+}
+
+// push queues w, force ignores the bound for the restored tasks. queued is called
+// once w is accepted, before a worker can take it.
+func (q *queue) push(w *worker, force bool, queued func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if !force && q.size > 0 && len(q.items) >= q.size {
+		return ErrQueueFull
+	}
+	if queued != nil {
+		queued()
+	}
+	q.insert(w)
+	q.cond.Signal()
+	return nil
+}
+
+// pushWait is push waiting for room in a full queue until ctx is done.
+func (q *queue) pushWait(ctx context.Context, w *worker, queued func()) error {
+	for {
+		err := q.push(w, false, queued)
+		if !errors.Is(err, ErrQueueFull) {
+			return err
+		}
+		q.mu.Lock()
+		room, full := q.room, len(q.items) >= q.size
+		q.mu.Unlock()
+		if !full {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return Cancelled(ctx)
+		case <-room:
+		}
+	}
+}
+
+// pop waits for the next task, nil tells the worker to exit.
+func (q *queue) pop() *worker {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed && q.quit == 0 {
+		q.cond.Wait()
+	}
+	if q.quit > 0 {
+		q.quit--
+		return nil
+	}
+	if len(q.items) == 0 {
+		return nil
+	}
+	w := q.items[0]
+	q.items = q.items[1:]
+	q.freed()
+	if w.taken != nil {
+		close(w.taken)
+	}
+	return w
+}
+
+// remove drops the queued task name, false when a worker took it already.
+func (q *queue) remove(name string) (*worker, bool) {
+	for i, w := range q.items {
+		if w.key == name {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return w, true
+		}
+	}
+	return nil, false
+}
+
+func (q *queue) setPriority(name string, p Priority) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w, ok := q.remove(name)
+	if !ok {
+		return fmt.Errorf("task %s is not queued", name)
+	}
+	w.info.Priority = p
+	q.insert(w)
+	return nil
+}
+
+// cancel drops the queued task name before a worker takes it.
+func (q *queue) cancel(name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.remove(name)
+	if ok {
+		q.freed()
+	}
+	return ok
+}
+
+func (q *queue) names() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	names := make([]string, 0, len(q.items))
+	for _, w := range q.items {
+		names = append(names, w.key)
+	}
+	return names
+}
+
+// shrink makes n workers exit once they are idle.
+func (q *queue) shrink(n int) {
+	q.mu.Lock()
+	q.quit += n
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// close lets the workers exit once the queue is empty.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.freed()
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
@@ -0,0 +1,70 @@
+package task
+
+import (
+	"errors"
+	"time"
+)
+
+// RetryPolicy runs a failed task again, Attempts counts the first run too.
+type RetryPolicy struct {
+	Attempts int
+	// Backoff is the wait before the second run, it doubles for every further run
+	Backoff time.Duration
+	// Retryable classifies the error of a run, DefaultRetryable when nil
+	Retryable func(error) bool
+}
+
+// Renewer is a task that can't be started twice, Renew returns the task of the next run.
+type Renewer interface {
+	Renew() (Task, error)
+}
+
+// Result is how a task ended after its retries.
+type Result struct {
+	Name     string
+	Status   Status
+	Attempts int
+	Err      error
+}
+
+// WithRetry runs the task up to p.Attempts times while its errors are retryable.
+func WithRetry(p RetryPolicy) TaskOption {
+	return func(info *WorkInfo) {
+		info.retry = p
+	}
+}
+
+// DefaultRetryable gives up on cancellations and invalid input only.
+func DefaultRetryable(err error) bool {
+	var invalid *ValidationError
+	return !IsCancelled(err) && !errors.As(err, &invalid)
+}
+
+// delay is the wait before run attempt+1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < time.Minute; i++ {
+		d *= 2
+	}
+	return d
+}
+
+// again reports whether a run failing with err after attempt runs is retried.
+func (p RetryPolicy) again(err error, attempt int) bool {
+	if err == nil || attempt >= p.Attempts {
+		return false
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+	return retryable(err)
+}
+
+// renew returns the task of the next run.
+func renew(t Task) (Task, error) {
+	if r, ok := t.(Renewer); ok {
+		return r.Renew()
+	}
+	return t, nil
+}
@@ -8,8 +8,11 @@ import (
 	"github.com/chestnutsj/hls/pkg/log"
 	"github.com/chestnutsj/hls/pkg/store"
 	"go.uber.org/zap"
+	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chestnutsj/hls/pkg/tools"
 )
@@ -23,6 +26,8 @@ const (
 	Completed
 
 	Aborted
+	// Failed is a task that returned an error other than a cancellation
+	Failed
 )
 
 var statusMap = map[Status]string{
@@ -31,6 +36,7 @@ var statusMap = map[Status]string{
 	Paused:    "paused",
 	Completed: "completed",
 	Aborted:   "aborted",
+	Failed:    "failed",
 }
 
 type Config struct {
@@ -39,14 +45,227 @@ type Config struct {
 	RetryCount  uint              `yaml:"retry_count" env:"RETRY" default:"10"`
 	ThreadSize  int               `yaml:"thread_size" env:"THREAD_SIZE" default:"10"`
 	Headers     map[string]string `yaml:"headers"`
+	// RateLimit is shared by all jobs of the process, e.g. "2M" bytes per second, empty is unlimited
+	RateLimit    string     `yaml:"rate_limit" env:"RATE_LIMIT"`
+	JobRateLimit string     `yaml:"job_rate_limit"`
+	RateSchedule []RateRule `yaml:"rate_schedule"`
+	// SyncPolicy is none, interval or always: when written data is fsynced before its progress is recorded
+	SyncPolicy   string `yaml:"sync_policy" default:"interval"`
+	SyncInterval uint   `yaml:"sync_interval" default:"1"`
+	// Preallocate reserves the whole file before downloading when the size is known
+	Preallocate bool `yaml:"preallocate"`
+	// ContentEncoding is decode, raw or identity: whether a single stream download is
+	// decoded, saved as the server encoded it, or asked not to be encoded
+	ContentEncoding string `yaml:"content_encoding" default:"decode"`
+	// Naming is auto, header, final or url: how a download without an output name is named
+	Naming string `yaml:"naming" default:"auto"`
+	// Auth is sent to the host of the job url, or to Auth.Hosts
+	Auth AuthConfig `yaml:"auth"`
+	// Proxy replaces the proxy of the environment
+	Proxy ProxyConfig `yaml:"proxy"`
+	TLS   TLSConfig   `yaml:"tls"`
+	// Network is the connection policy of the transport shared by the jobs of the process
+	Network NetworkConfig `yaml:"network"`
+	// SSH verifies and authenticates the sftp:// servers, the user and password come from
+	// the url or Auth
+	SSH SSHConfig `yaml:"ssh"`
+	// S3 is the object store of the s3://bucket/key urls
+	S3 S3Config `yaml:"s3"`
+	// Request shapes the HTTP requests of the downloads and of the m3u segments
+	Request RequestConfig `yaml:"request"`
+	// TaskRetries runs a failed segment again that many times, the progress on disk is kept
+	TaskRetries uint `yaml:"task_retries" default:"2"`
+	// Refresh renews the signed segment urls of an m3u download refused with 401 or 403
+	Refresh RefreshConfig `yaml:"refresh"`
 }
 
+// RefreshConfig tells where the new segment urls come from, the playlist is fetched
+// again from its url without Command and Hook.
+type RefreshConfig struct {
+	// Times is how often one segment may be refreshed, 0 disables the refresh
+	Times uint `yaml:"times" default:"3"`
+	// Command prints a new playlist url, it gets the current one in HLS_PLAYLIST_URL
+	Command string `yaml:"command"`
+	// Hook names a refresher of m3u.RegisterRefresher
+	Hook string `yaml:"hook"`
+}
+
+// RequestConfig changes the requests sent by the download client. Body, Headers and Query
+// are text/template strings, the fields are those of download.RequestVars, e.g.
+// {{.Index}}, {{.Path}} or {{.Timestamp}}.
+type RequestConfig struct {
+	// Method is GET when empty
+	Method string `yaml:"method"`
+	Body   string `yaml:"body"`
+	// ContentType of the body, JSON or form by its first character when empty
+	ContentType string `yaml:"content_type"`
+	// Headers are rendered for every request and win over Config.Headers
+	Headers map[string]string `yaml:"headers"`
+	// Query adds or replaces parameters of the url
+	Query map[string]string `yaml:"query"`
+	// Signer names a hook of download.RegisterSigner, it runs before every attempt
+	Signer string `yaml:"signer"`
+}
+
+// SSHConfig holds the keys of the sftp:// downloads.
+type SSHConfig struct {
+	// KeyFile is a private key, ~/.ssh/id_ed25519 and ~/.ssh/id_rsa are tried without it
+	KeyFile string `yaml:"key_file"`
+	// KnownHosts verifies the host keys, ~/.ssh/known_hosts by default
+	KnownHosts string `yaml:"known_hosts"`
+}
+
+// S3Config is an S3 compatible store, requests are signed with AWS signature v4 when
+// AccessKey is set.
+type S3Config struct {
+	// Endpoint is e.g. "http://minio:9000", empty is AWS in Region
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region" default:"us-east-1"`
+	// PathStyle puts the bucket in the path instead of the host name, MinIO usually needs it
+	PathStyle    bool   `yaml:"path_style"`
+	AccessKey    string `yaml:"access_key" env:"AWS_ACCESS_KEY_ID"`
+	SecretKey    string `yaml:"secret_key" env:"AWS_SECRET_ACCESS_KEY"`
+	SessionToken string `yaml:"session_token" env:"AWS_SESSION_TOKEN"`
+}
+
+// String hides the secrets when the config is printed.
+func (s S3Config) String() string {
+	secret := ""
+	if s.SecretKey != "" {
+		secret = "***"
+	}
+	token := ""
+	if s.SessionToken != "" {
+		token = "***"
+	}
+	return fmt.Sprintf("{%s %s %v %s %s %s}", s.Endpoint, s.Region, s.PathStyle, s.AccessKey, secret, token)
+}
+
+// NetworkConfig limits and tunes the connections to the origins.
+type NetworkConfig struct {
+	// MaxConnsPerHost caps the connections to one host over all jobs, 0 is unlimited
+	MaxConnsPerHost int `yaml:"max_conns_per_host"`
+	// HTTP2 lets https origins speak HTTP/2. All requests to a host then share one
+	// connection, so the range threads no longer get a connection each, off by default.
+	HTTP2 bool `yaml:"http2"`
+	// DNSCacheTTL keeps resolved addresses for that many seconds, 0 disables the cache
+	DNSCacheTTL uint `yaml:"dns_cache_ttl" default:"60"`
+	// Resolve pins host:port to an address like curl --resolve, e.g. "cdn.example.com:443:10.0.0.1"
+	Resolve []string `yaml:"resolve"`
+}
+
+// TLSConfig adjusts the verification of https servers, empty fields keep the defaults.
+type TLSConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and key for mutual TLS
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// MinVersion is "1.0" to "1.3"
+	MinVersion string `yaml:"min_version"`
+	// ServerName overrides the SNI and the name the certificate is checked against
+	ServerName string `yaml:"server_name"`
+	// Pins are base64 sha256 hashes of a SPKI in the chain, "sha256//" prefixed like curl
+	Pins []string `yaml:"pins"`
+}
+
+// ProxyDirect as a proxy url sends the requests without a proxy.
+const ProxyDirect = "direct"
+
+// ProxyConfig picks the proxy of a request: hosts in NoProxy go direct, then the first
+// matching rule wins, then URL. Without any the environment (HTTP_PROXY etc.) is used.
+// A proxy is http://, https://, socks5:// or socks5h://, user:password@ in the url
+// authenticates to it.
+type ProxyConfig struct {
+	URL     string      `yaml:"url" env:"HLS_PROXY"`
+	Rules   []ProxyRule `yaml:"rules"`
+	NoProxy []string    `yaml:"no_proxy"`
+	// Key is the proxy of the HLS key requests, e.g. "direct" while the segments use URL
+	Key string `yaml:"key"`
+}
+
+// ProxyRule sends the requests to Hosts through Proxy. A host is "example.com" (with its
+// subdomains), "*.example.com", "*" or a CIDR like "10.0.0.0/8".
+type ProxyRule struct {
+	Hosts []string `yaml:"hosts"`
+	Proxy string   `yaml:"proxy"`
+}
+
+// ForKeys returns the proxy config of key requests.
+func (p ProxyConfig) ForKeys() ProxyConfig {
+	if p.Key == "" {
+		return p
+	}
+	return ProxyConfig{URL: p.Key, NoProxy: p.NoProxy}
+}
+
+func (p ProxyConfig) String() string {
+	rules := make([]ProxyRule, len(p.Rules))
+	for i, r := range p.Rules {
+		rules[i] = ProxyRule{Hosts: r.Hosts, Proxy: redact(r.Proxy)}
+	}
+	return fmt.Sprintf("{%s %v %v %s}", redact(p.URL), rules, p.NoProxy, redact(p.Key))
+}
+
+// redact hides the password of a url.
+func redact(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+// AuthConfig holds the credentials of the download client. Token, TokenEnv and TokenFile
+// give a bearer token, User and Password are used for basic or digest auth.
+type AuthConfig struct {
+	Type      string   `yaml:"type" default:"basic"`
+	User      string   `yaml:"user" env:"AUTH_USER"`
+	Password  string   `yaml:"password" env:"AUTH_PASSWORD"`
+	Token     string   `yaml:"token"`
+	TokenEnv  string   `yaml:"token_env"`
+	TokenFile string   `yaml:"token_file"`
+	Hosts     []string `yaml:"hosts"`
+	// Netrc looks the credentials up by host in NetrcFile, ~/.netrc by default
+	Netrc     bool   `yaml:"netrc"`
+	NetrcFile string `yaml:"netrc_file"`
+	// CookieFile is a Netscape cookies.txt, the jar is shared by all jobs of the process
+	CookieFile string `yaml:"cookie_file"`
+}
+
+// String hides the secrets when the config is printed.
+func (a AuthConfig) String() string {
+	mask := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "***"
+	}
+	return fmt.Sprintf("{%s %s %s %s %s %s %v %v %s %s}", a.Type, a.User, mask(a.Password), mask(a.Token),
+		a.TokenEnv, a.TokenFile, a.Hosts, a.Netrc, a.NetrcFile, a.CookieFile)
+}
+
+// RateRule replaces the global rate limit between Start and End ("HH:MM"), "0" is unlimited.
+type RateRule struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	Limit string `yaml:"limit"`
+}
+
+// NewDownloadConfig is the config of a library caller, the defaults match the ones
+// the command line loads.
 func NewDownloadConfig() *Config {
 	return &Config{
-		ConnTimeout: 5,
-		ChunkSize:   1024 * 1024 * 10,
-		RetryCount:  5,
-		ThreadSize:  10,
+		ConnTimeout:     5,
+		ChunkSize:       1024 * 1024 * 10,
+		RetryCount:      5,
+		ThreadSize:      10,
+		SyncPolicy:      "interval",
+		SyncInterval:    1,
+		ContentEncoding: "decode",
+		Naming:          "auto",
+		Network:         NetworkConfig{DNSCacheTTL: 60},
+		TaskRetries:     2,
+		Refresh:         RefreshConfig{Times: 3},
 	}
 }
 
@@ -66,7 +285,9 @@ var (
 )
 
 type Manager interface {
-	NewTask(name string, t Task) error
+	NewTask(name string, t Task, opts ...TaskOption) error
+	// WaitTask is NewTask waiting for room in a full queue, see WithQueueSize
+	WaitTask(ctx context.Context, name string, t Task, opts ...TaskOption) error
 	GetTask(name string) (Task, error)
 	ExitTask(name string) error
 	StopTask(name string) error
@@ -75,6 +296,19 @@ type Manager interface {
 	StopAll() error
 	ResumeAll() error
 	GetAll() ([]interface{}, error)
+	// History lists every task the status file knows in queue order, finished ones included
+	History() ([]WorkInfo, error)
+	// Queued lists the tasks no worker took yet in the order they will run
+	Queued() []string
+	// SetPriority moves a queued task
+	SetPriority(name string, p Priority) error
+	// Results lists the tasks that ended for good, after their retries, in that order
+	Results() []Result
+	// Restore queues the tasks WithRebuild rebuilt, once the owner starts
+	Restore()
+	// Subscribe and Events deliver the events of the tasks, see Event
+	Subscribe(f func(Event)) (cancel func())
+	Events(buffer int) (<-chan Event, func())
 	Resize(newMaxWorkers int)
 }
 
@@ -83,37 +317,70 @@ type manager struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	stop   chan []interface{}
-	resume chan []interface{}
+	pauseMu sync.Mutex
+	paused  bool
+	resume  chan struct{}
 
 	cache *store.BitCask
-
-	works      chan *worker   // 任务通道
+	// seq orders the tasks in the status file
+	seq atomic.Int64
+	// restore rebuilds the unfinished tasks of the status file, which is kept on Close
+	restore *restoreConfig
+	// held are the tasks of WithRebuild waiting for Restore
+	held []*worker
+
+	queue      *queue         // 任务队列
+	retry      RetryPolicy    // 默认重试策略
+	active     sync.WaitGroup // 未结束的任务, 含等待重试的
+	resultMu   sync.Mutex
+	results    []Result
 	wg         sync.WaitGroup // 同步等待组
 	maxWorkers int            // 最大工作数量
 	mutex      sync.Mutex     // 保护 maxWorkers 读写的互斥锁
 
+	events        bus
+	progressEvery time.Duration
+	// sampling is closed to stop the progress events
+	sampling chan struct{}
 }
 
 type worker struct {
-	key string
-	t   Task
+	key  string
+	t    Task
+	info WorkInfo
+	// taken is closed when a worker takes the task from the queue
+	taken chan struct{}
 }
 type WorkInfo struct {
 	Status Status
 	Extra  []byte
 	Type   string
+	// Name is the key of the task, Seq its place in the queue
+	Name     string   `json:",omitempty"`
+	Seq      int64    `json:",omitempty"`
+	Priority Priority `json:",omitempty"`
+	// Order places the task for the PlaybackOrder policy
+	Order int64 `json:",omitempty"`
+	// Label is kept for the owner of the task, e.g. what a rebuild needs to know
+	Label    string `json:",omitempty"`
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+	// Error is why a failed or aborted task stopped
+	Error    string `json:",omitempty"`
+	Attempts int    `json:",omitempty"`
+
+	retry RetryPolicy
 }
 
 func (w *worker) SaveInCache(cache *store.BitCask) {
 	if cache != nil {
 		data, err := w.t.Extra()
 		if err == nil {
-			info := WorkInfo{
-				Extra:  data,
-				Type:   w.t.GetType(),
-				Status: w.t.GetStatus(),
-			}
+			info := w.info
+			info.Name = w.key
+			info.Extra = data
+			info.Type = w.t.GetType()
 			b, _ := json.Marshal(info)
 			_ = cache.Set(w.key, b)
 		}
@@ -121,25 +388,91 @@ func (w *worker) SaveInCache(cache *store.BitCask) {
 	}
 }
 
+// finish records how the run of the task ended.
+func (w *worker) finish(err error) {
+	w.info.Finished = time.Now()
+	w.info.Status = w.t.GetStatus()
+	w.info.Error = ""
+	if err != nil {
+		w.info.Error = err.Error()
+		w.info.Status = Failed
+		if IsCancelled(err) {
+			w.info.Status = Aborted
+		}
+	}
+}
+
 func (m *manager) workRun(name string, t Task) error {
 	defer m.tasks.Delete(name)
 	return t.Start()
 }
 
-func (m *manager) NewTask(name string, t Task) error {
+// NewTask queues t. Without WithQueueSize it returns once a worker took t, with it
+// a full queue fails with ErrQueueFull at once.
+func (m *manager) NewTask(name string, t Task, opts ...TaskOption) error {
+	return m.add(name, t, func(w *worker, queued func()) error {
+		return m.queue.push(w, false, queued)
+	}, opts...)
+}
+
+// WaitTask is NewTask waiting for room in a full queue until ctx is done.
+func (m *manager) WaitTask(ctx context.Context, name string, t Task, opts ...TaskOption) error {
+	return m.add(name, t, func(w *worker, queued func()) error {
+		return m.queue.pushWait(ctx, w, queued)
+	}, opts...)
+}
+
+// add records t and queues it with push.
+func (m *manager) add(name string, t Task, push func(w *worker, queued func()) error, opts ...TaskOption) error {
 	_, exists := m.tasks.Get(name)
 	if exists {
 		return fmt.Errorf("task %s already exists", name)
 	}
+	w := &worker{key: name, t: t, info: WorkInfo{Status: t.GetStatus(), Created: time.Now()}}
+	for _, opt := range opts {
+		opt(&w.info)
+	}
+	var taken chan struct{}
+	if m.queue.size <= 0 {
+		taken = make(chan struct{})
+		w.taken = taken
+	}
 	m.tasks.Set(name, t)
-	w := &worker{key: name, t: t}
-	if m.cache != nil {
+	w.info.Seq = m.seq.Add(1)
+	m.active.Add(1)
+	err := push(w, func() {
+		// recorded before a worker can take it
 		w.SaveInCache(m.cache)
+		m.events.publish(Event{Type: EventQueued, Name: name})
+	})
+	if err != nil {
+		m.tasks.Delete(name)
+		m.active.Done()
+		return err
+	}
+	if taken == nil {
+		return nil
+	}
+	select {
+	case <-taken:
+	case <-m.ctx.Done():
+		if m.queue.cancel(name) {
+			m.tasks.Delete(name)
+			m.active.Done()
+			return Cancelled(m.ctx)
+		}
 	}
-	m.works <- w
 	return nil
 }
 
+func (m *manager) Queued() []string {
+	return m.queue.names()
+}
+
+func (m *manager) SetPriority(name string, p Priority) error {
+	return m.queue.setPriority(name, p)
+}
+
 func (m *manager) GetTask(name string) (Task, error) {
 	t, e := m.tasks.Get(name)
 	if !e {
@@ -161,7 +494,11 @@ func (m *manager) StopTask(name string) error {
 	if !e {
 		return nil
 	}
-	return t.(Task).Stop()
+	if err := t.(Task).Stop(); err != nil {
+		return err
+	}
+	m.events.publish(Event{Type: EventPaused, Name: name})
+	return nil
 }
 
 func (m *manager) ResumeTask(name string) error {
@@ -169,36 +506,73 @@ func (m *manager) ResumeTask(name string) error {
 	if !e {
 		return nil
 	}
-	return t.(Task).Resume()
+	if err := t.(Task).Resume(); err != nil {
+		return err
+	}
+	m.events.publish(Event{Type: EventResumed, Name: name})
+	return nil
 }
 
+// Close waits for the queued tasks and their retries, the workers exit then.
 func (m *manager) Close() error {
-	close(m.works)
+	m.active.Wait()
+	m.queue.close()
 	m.wg.Wait()
+	close(m.sampling)
+	m.events.close()
 	if m.cache != nil {
 		return m.cleanCache()
 	}
 	return nil
 }
 
+// StopAll pauses the running tasks, queued tasks are not started until ResumeAll.
 func (m *manager) StopAll() error {
+	m.pauseMu.Lock()
+	m.paused = true
+	m.pauseMu.Unlock()
 	err := m.tasks.Fetch(func(i interface{}) error {
 		return i.(Task).Stop()
 	}, true)
-	close(m.stop)
+	m.publishAll(EventPaused)
 	return err
 }
 
 func (m *manager) ResumeAll() error {
-	m.stop = make(chan []interface{})
-	close(m.resume)
-	m.resume = make(chan []interface{})
+	m.pauseMu.Lock()
+	if m.paused {
+		m.paused = false
+		close(m.resume)
+		m.resume = make(chan struct{})
+	}
+	m.pauseMu.Unlock()
 	err := m.tasks.Fetch(func(i interface{}) error {
 		return i.(Task).Resume()
 	}, true)
+	m.publishAll(EventResumed)
 	return err
 }
 
+// publishAll publishes t for every task the manager holds.
+func (m *manager) publishAll(t EventType) {
+	for _, name := range m.tasks.Keys() {
+		m.events.publish(Event{Type: t, Name: name})
+	}
+}
+
+// waitResume blocks while the manager is paused.
+func (m *manager) waitResume() {
+	m.pauseMu.Lock()
+	paused, resume := m.paused, m.resume
+	m.pauseMu.Unlock()
+	if paused {
+		select {
+		case <-resume:
+		case <-m.ctx.Done():
+		}
+	}
+}
+
 func (m *manager) GetAll() ([]interface{}, error) {
 	return m.tasks.Values(), nil
 }
@@ -222,14 +596,84 @@ func (m *manager) cleanCache() error {
 		if err != nil {
 			return err
 		}
-		if !stop {
+		if !stop && m.restore == nil {
 			_ = os.RemoveAll(m.cache.GetPath())
 		}
 	}
 	return nil
 }
 
-func NewManager(ctx context.Context, maxWorkers int, status string) Manager {
+// retryLater queues the next run of a task that failed with a retryable error.
+func (m *manager) retryLater(w *worker, err error) bool {
+	p := w.info.retry
+	if p.Attempts == 0 {
+		p = m.retry
+	}
+	if !p.again(err, w.info.Attempts) || m.ctx.Err() != nil {
+		return false
+	}
+	next, rErr := renew(w.t)
+	if rErr != nil {
+		log.Error("renew task failed", zap.String("name", w.key), zap.Error(rErr))
+		return false
+	}
+	delay := p.delay(w.info.Attempts)
+	log.Warn("retry task", zap.String("name", w.key), zap.Int("attempt", w.info.Attempts), zap.Duration("delay", delay), zap.Error(err))
+	w.t = next
+	w.taken = nil
+	w.info.Status = Pending
+	w.info.Finished = time.Time{}
+	m.tasks.Set(w.key, next)
+	if m.cache != nil {
+		w.SaveInCache(m.cache)
+	}
+	m.events.publish(Event{Type: EventRetried, Name: w.key, Attempt: w.info.Attempts, Err: err})
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-m.ctx.Done():
+		}
+		// Close waits for the retry, the queue is still open
+		_ = m.queue.push(w, true, nil)
+	}()
+	return true
+}
+
+// done records the result of a task that won't run again.
+func (m *manager) done(w *worker, err error) {
+	m.resultMu.Lock()
+	m.results = append(m.results, Result{Name: w.key, Status: w.info.Status, Attempts: w.info.Attempts, Err: err})
+	m.resultMu.Unlock()
+	e := Event{Type: EventCompleted, Name: w.key, Attempt: w.info.Attempts, Err: err}
+	switch w.info.Status {
+	case Failed:
+		e.Type = EventFailed
+	case Aborted:
+		e.Type = EventAborted
+	}
+	m.events.publish(e)
+	m.active.Done()
+}
+
+func (m *manager) Results() []Result {
+	m.resultMu.Lock()
+	defer m.resultMu.Unlock()
+	return append([]Result(nil), m.results...)
+}
+
+// WithDefaultRetry is the retry policy of the tasks added without WithRetry, the
+// restored ones included.
+func WithDefaultRetry(p RetryPolicy) ManagerOption {
+	return func(m *manager) {
+		m.retry = p
+	}
+}
+
+// ManagerOption configures NewManager.
+type ManagerOption func(*manager)
+
+// NewManager runs the tasks on maxWorkers workers and records them in the status file.
+func NewManager(ctx context.Context, maxWorkers int, status string, opts ...ManagerOption) Manager {
 	cache, err := store.NewBitCask(status)
 	if err != nil {
 		log.Error("create mgr status failed", zap.String("name", status), zap.Error(err))
@@ -245,13 +689,24 @@ func NewManager(ctx context.Context, maxWorkers int, status string) Manager {
 		ctx:    ctx,
 		cancel: cancel,
 
-		stop:       make(chan []interface{}),
-		resume:     make(chan []interface{}),
+		resume:     make(chan struct{}),
 		cache:      cache,
 		maxWorkers: maxWorkers,
-		works:      make(chan *worker),
+		queue:      newQueue(),
+		sampling:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	restored := m.load()
+	if m.restore != nil && m.restore.rebuild != nil {
+		// nothing runs before the owner starts
+		m.held = restored
+	} else {
+		m.queueRestored(restored)
 	}
-	go m.run()
+	go m.sample()
+	m.run()
 	return m
 }
 
@@ -265,15 +720,29 @@ func (m *manager) run() {
 
 func (m *manager) worker() {
 	defer m.wg.Done()
-	for t := range m.works {
+	for {
+		t := m.queue.pop()
 		if t != nil {
+			m.waitResume()
+			t.info.Started = time.Now()
+			t.info.Status = Running
+			t.info.Attempts++
+			if m.cache != nil {
+				t.SaveInCache(m.cache)
+			}
+			m.events.publish(Event{Type: EventStarted, Name: t.key, Attempt: t.info.Attempts})
 			err := m.workRun(t.key, t.t)
-			if err != nil {
-				log.Error("work run failed", zap.Error(err))
+			if err != nil && !IsCancelled(err) {
+				log.Error("work run failed", zap.String("name", t.key), zap.Int("attempt", t.info.Attempts), zap.Error(err))
+			}
+			t.finish(err)
+			if m.retryLater(t, err) {
+				continue
 			}
 			if m.cache != nil {
 				t.SaveInCache(m.cache)
 			}
+			m.done(t, err)
 		} else {
 			return
 		}
@@ -299,9 +768,7 @@ func (m *manager) Resize(newMaxWorkers int) {
 		}
 	} else {
 		// 减少工作数量，关闭多余的 Goroutines
-		for i := newMaxWorkers; i < m.maxWorkers; i++ {
-			m.works <- nil
-		}
+		m.queue.shrink(m.maxWorkers - newMaxWorkers)
 	}
 
 	m.maxWorkers = newMaxWorkers
@@ -2,7 +2,17 @@ package task
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/chestnutsj/hls/pkg/display"
 	"github.com/chestnutsj/hls/pkg/log"
+	"github.com/chestnutsj/hls/pkg/store"
+	"github.com/jinzhu/configor"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -87,3 +97,377 @@ func Test_taskMgr(t *testing.T) {
 		t.Fatal("not ctrl task")
 	}
 }
+
+func Test_taskMgrPause(t *testing.T) {
+	err := log.DevLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr := NewManager(context.Background(), 1, t.TempDir()+"/pause.xz3")
+	if mgr == nil {
+		t.Fatal("init mgr failed")
+	}
+	var ran atomic.Bool
+	_ = mgr.StopAll()
+	go mgr.NewTask("test1", newTestJob(func() { ran.Store(true) }))
+
+	<-time.After(time.Millisecond * 1500)
+	if ran.Load() {
+		t.Fatal("queued task started while paused")
+	}
+	_ = mgr.ResumeAll()
+	<-time.After(time.Millisecond * 100)
+	mgr.Close()
+	if !ran.Load() {
+		t.Fatal("task not run after resume")
+	}
+}
+
+// queuedJob records the order the manager runs it in.
+type queuedJob struct {
+	testJob
+	name string
+	ran  chan<- string
+	// wait holds Start until it is closed
+	wait <-chan struct{}
+}
+
+func (j *queuedJob) GetType() string { return "queued" }
+
+func (j *queuedJob) Start() error {
+	if j.wait != nil {
+		<-j.wait
+	}
+	j.status.Store(Completed)
+	j.ran <- j.name
+	return nil
+}
+
+func (j *queuedJob) Extra() ([]byte, error) { return json.Marshal(j.name) }
+
+func Test_taskMgrRestore(t *testing.T) {
+	ran := make(chan string, 10)
+	NewTaskMap["queued"] = func(ctx context.Context, displayOpt *display.Display, cfg *Config, value []byte) (Task, error) {
+		j := &queuedJob{ran: ran}
+		return j, json.Unmarshal(value, &j.name)
+	}
+	status := filepath.Join(t.TempDir(), "queue.xz3")
+	cache, err := store.NewBitCask(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range []WorkInfo{
+		{Name: "a", Seq: 1, Status: Completed},
+		{Name: "c", Seq: 2, Status: Aborted, Error: "cancelled"},
+		{Name: "b", Seq: 3, Status: Pending},
+		{Name: "d", Seq: 4, Status: Failed},
+	} {
+		info.Type = "queued"
+		info.Extra, _ = json.Marshal(info.Name)
+		b, _ := json.Marshal(info)
+		_ = cache.Set(info.Name, b)
+	}
+	_ = cache.Close()
+
+	mgr := NewManager(context.Background(), 1, status, WithRestore(nil, NewDownloadConfig()))
+	if mgr == nil {
+		t.Fatal("init mgr failed")
+	}
+	_ = mgr.NewTask("e", &queuedJob{name: "e", ran: ran})
+	_ = mgr.Close()
+	close(ran)
+	var order []string
+	for name := range ran {
+		order = append(order, name)
+	}
+	if strings.Join(order, ",") != "c,b,e" {
+		t.Fatal("run order", order)
+	}
+
+	mgr = NewManager(context.Background(), 1, status)
+	history, err := mgr.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = mgr.Close()
+	var names []string
+	for _, info := range history {
+		names = append(names, info.Name+":"+strconv.Itoa(int(info.Status)))
+		if info.Name == "e" && (info.Seq != 5 || info.Started.IsZero() || info.Finished.IsZero()) {
+			t.Fatalf("e %+v", info)
+		}
+	}
+	want := fmt.Sprintf("a:%d,c:%d,b:%d,d:%d,e:%d", Completed, Completed, Completed, Failed, Completed)
+	if strings.Join(names, ",") != want {
+		t.Fatal("history", names)
+	}
+}
+
+func Test_taskMgrQueue(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy Policy
+		add    func(mgr Manager, ran chan<- string) error
+		want   string
+	}{
+		{"priority", FIFO, func(mgr Manager, ran chan<- string) error {
+			_ = mgr.NewTask("low", &queuedJob{name: "low", ran: ran}, WithPriority(PriorityLow))
+			_ = mgr.NewTask("normal", &queuedJob{name: "normal", ran: ran})
+			if err := mgr.NewTask("full", &queuedJob{name: "full", ran: ran}); !errors.Is(err, ErrQueueFull) {
+				return fmt.Errorf("full queue: %v", err)
+			}
+			if q := strings.Join(mgr.Queued(), ","); q != "normal,low" {
+				return fmt.Errorf("queued %s", q)
+			}
+			return mgr.SetPriority("low", PriorityHigh)
+		}, "block,low,normal"},
+		{"playback", PlaybackOrder, func(mgr Manager, ran chan<- string) error {
+			_ = mgr.NewTask("3", &queuedJob{name: "3", ran: ran}, WithOrder(3))
+			_ = mgr.NewTask("1", &queuedJob{name: "1", ran: ran}, WithOrder(1))
+			return nil
+		}, "block,1,3"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ran := make(chan string, 10)
+			mgr := NewManager(context.Background(), 1, filepath.Join(t.TempDir(), "queue.xz3"),
+				WithQueueSize(2), WithPolicy(c.policy))
+			release := make(chan struct{})
+			_ = mgr.NewTask("block", &queuedJob{name: "block", ran: ran, wait: release})
+			for len(mgr.Queued()) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			err := c.add(mgr, ran)
+			close(release)
+			_ = mgr.Close()
+			close(ran)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var order []string
+			for name := range ran {
+				order = append(order, name)
+			}
+			if strings.Join(order, ",") != c.want {
+				t.Fatal("run order", order)
+			}
+		})
+	}
+}
+
+func Test_taskMgrWaitTask(t *testing.T) {
+	ran := make(chan string, 10)
+	mgr := NewManager(context.Background(), 1, filepath.Join(t.TempDir(), "wait.xz3"), WithQueueSize(1))
+	release := make(chan struct{})
+	_ = mgr.NewTask("block", &queuedJob{name: "block", ran: ran, wait: release})
+	for len(mgr.Queued()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_ = mgr.NewTask("queued", &queuedJob{name: "queued", ran: ran})
+
+	// a cancelled wait leaves nothing behind
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := mgr.WaitTask(ctx, "late", &queuedJob{name: "late", ran: ran}); !IsCancelled(err) {
+		t.Fatal("want cancelled", err)
+	}
+	if late, _ := mgr.GetTask("late"); late != nil {
+		t.Fatal("cancelled task is still known")
+	}
+
+	added := make(chan error, 1)
+	go func() {
+		added <- mgr.WaitTask(context.Background(), "waits", &queuedJob{name: "waits", ran: ran})
+	}()
+	select {
+	case err := <-added:
+		t.Fatal("added to a full queue", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the worker takes the queued task and makes room
+	close(release)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	_ = mgr.Close()
+	close(ran)
+	var order []string
+	for name := range ran {
+		order = append(order, name)
+	}
+	if strings.Join(order, ",") != "block,queued,waits" {
+		t.Fatal("run order", order)
+	}
+}
+
+// flakyJob fails until its shared run count reaches ok, Renew hands the count on.
+type flakyJob struct {
+	testJob
+	runs *atomic.Int32
+	ok   int32
+	err  error
+}
+
+func (j *flakyJob) Start() error {
+	if j.runs.Add(1) < j.ok {
+		j.status.Store(Failed)
+		return j.err
+	}
+	j.status.Store(Completed)
+	return nil
+}
+
+func (j *flakyJob) Renew() (Task, error) {
+	return &flakyJob{runs: j.runs, ok: j.ok, err: j.err}, nil
+}
+
+func Test_taskMgrRetry(t *testing.T) {
+	mgr := NewManager(context.Background(), 2, filepath.Join(t.TempDir(), "retry.xz3"),
+		WithDefaultRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond}))
+	var flaky, invalid, exhausted atomic.Int32
+	_ = mgr.NewTask("flaky", &flakyJob{runs: &flaky, ok: 3, err: errors.New("flaky")})
+	_ = mgr.NewTask("invalid", &flakyJob{runs: &invalid, ok: 3, err: Invalid("url", errors.New("bad"))})
+	_ = mgr.NewTask("exhausted", &flakyJob{runs: &exhausted, ok: 5, err: errors.New("down")},
+		WithRetry(RetryPolicy{Attempts: 2}))
+	_ = mgr.Close()
+
+	got := make(map[string]Result)
+	for _, r := range mgr.Results() {
+		got[r.Name] = r
+	}
+	for name, want := range map[string]Result{
+		"flaky":     {Status: Completed, Attempts: 3},
+		"invalid":   {Status: Failed, Attempts: 1},
+		"exhausted": {Status: Failed, Attempts: 2},
+	} {
+		r := got[name]
+		if r.Status != want.Status || r.Attempts != want.Attempts || (r.Status == Failed) != (r.Err != nil) {
+			t.Errorf("%s: %+v", name, r)
+		}
+	}
+}
+
+// reportJob reports progress until it is released.
+type reportJob struct {
+	testJob
+	wait <-chan struct{}
+}
+
+func (j *reportJob) Start() error {
+	j.status.Store(Running)
+	<-j.wait
+	j.status.Store(Completed)
+	return nil
+}
+
+func (j *reportJob) Transferred() (int64, int64) { return 50, 100 }
+
+func Test_taskMgrEvents(t *testing.T) {
+	mgr := NewManager(context.Background(), 2, filepath.Join(t.TempDir(), "events.xz3"),
+		WithDefaultRetry(RetryPolicy{Attempts: 2}), WithProgressInterval(10*time.Millisecond))
+	events, cancel := mgr.Events(0)
+	defer cancel()
+	var slow atomic.Int32
+	stop := mgr.Subscribe(func(Event) {
+		// a slow subscriber must not hold the others
+		time.Sleep(50 * time.Millisecond)
+		slow.Add(1)
+	})
+	defer stop()
+
+	release := make(chan struct{})
+	var flaky atomic.Int32
+	_ = mgr.NewTask("report", &reportJob{wait: release})
+	_ = mgr.NewTask("flaky", &flakyJob{runs: &flaky, ok: 2, err: errors.New("flaky")})
+	var got []string
+	for e := range events {
+		got = append(got, e.Name+":"+e.Type.String())
+		if e.Type == EventProgress && (e.Bytes != 50 || e.Total != 100) {
+			t.Fatalf("%+v", e)
+		}
+		if e.Name == "report" && e.Type == EventProgress {
+			close(release)
+			go func() { _ = mgr.Close() }()
+		}
+	}
+	seq := func(name string) string {
+		var s []string
+		for _, e := range got {
+			if strings.HasPrefix(e, name+":") && !strings.HasSuffix(e, ":progress") {
+				s = append(s, strings.TrimPrefix(e, name+":"))
+			}
+		}
+		return strings.Join(s, ",")
+	}
+	if s := seq("report"); s != "queued,started,completed" {
+		t.Fatal("report", s, got)
+	}
+	if s := seq("flaky"); s != "queued,started,retried,started,completed" {
+		t.Fatal("flaky", s, got)
+	}
+}
+
+func Test_NewDownloadConfig(t *testing.T) {
+	var loaded Config
+	if err := configor.New(&configor.Config{}).Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewDownloadConfig()
+	// the defaults that change the behaviour, the sizes and timeouts differ on purpose
+	for _, f := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"SyncPolicy", cfg.SyncPolicy, loaded.SyncPolicy},
+		{"SyncInterval", cfg.SyncInterval, loaded.SyncInterval},
+		{"ContentEncoding", cfg.ContentEncoding, loaded.ContentEncoding},
+		{"Naming", cfg.Naming, loaded.Naming},
+		{"Network", cfg.Network, loaded.Network},
+		{"Refresh", cfg.Refresh, loaded.Refresh},
+		{"TaskRetries", cfg.TaskRetries, loaded.TaskRetries},
+	} {
+		if !reflect.DeepEqual(f.got, f.want) {
+			t.Errorf("%s: %v, the command line loads %v", f.name, f.got, f.want)
+		}
+	}
+}
+
+func Test_busLagged(t *testing.T) {
+	var b bus
+	release := make(chan struct{})
+	var got []Event
+	exited := make(chan struct{})
+	b.subscribe(func(e Event) {
+		<-release
+		got = append(got, e)
+	}, func() { close(exited) })
+	subscribed := func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.subs) == 1
+	}
+
+	// a stalled subscriber is kept up to the bound and dropped past it
+	for i := 0; i < subscriberQueue; i++ {
+		b.publish(Event{Type: EventQueued, Name: strconv.Itoa(i)})
+	}
+	if !subscribed() {
+		t.Fatal("dropped within the bound")
+	}
+	for i := 0; i <= subscriberQueue; i++ {
+		b.publish(Event{Type: EventQueued, Name: "more"})
+	}
+	if subscribed() {
+		t.Fatal("kept past the bound")
+	}
+	close(release)
+	<-exited
+	// the batch in delivery and the full queue
+	if len(got) > 2*subscriberQueue+1 || got[len(got)-1].Type != EventLagged {
+		t.Fatal("stalled subscriber got", len(got), got[len(got)-1].Type)
+	}
+	for i, e := range got[:subscriberQueue] {
+		if e.Name != strconv.Itoa(i) {
+			t.Fatal("event", i, e.Name)
+		}
+	}
+}
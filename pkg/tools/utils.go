@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -34,11 +35,14 @@ func GenerateUniqueFilename(original string, newExt ...string) (string, error) {
 	// Try the original filename first.
 	if _, err := os.Stat(original); os.IsNotExist(err) {
 		return original, nil
+	} else if err != nil {
+		return "", err
 	}
 
+	// a status file next to it is an unfinished download, it continues in place
 	if len(newExt) > 0 {
 		statusFile := filepath.Join(dirName, stem+newExt[0])
-		if _, err := os.Stat(statusFile); os.IsNotExist(err) {
+		if _, err := os.Stat(statusFile); err == nil {
 			return original, nil
 		}
 	}
@@ -48,6 +52,8 @@ func GenerateUniqueFilename(original string, newExt ...string) (string, error) {
 		newPath := filepath.Join(dirName, newBaseName)
 		if _, err := os.Stat(newPath); os.IsNotExist(err) {
 			return newPath, nil
+		} else if err != nil {
+			return "", err
 		}
 	}
 }
@@ -94,3 +100,29 @@ func FindUncoveredPositions(total int64, boundaries []int64, limit int64) map[in
 
 	return uncovered
 }
+
+// MergeRanges merges the [start, end) ranges of m into sorted boundaries
+// start0, end0, start1, end1 ... as used by FindUncoveredPositions.
+func MergeRanges(m map[int64]int64) []int64 {
+	starts := make([]int64, 0, len(m))
+	for k, v := range m {
+		if v > k {
+			starts = append(starts, k)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	boundaries := make([]int64, 0, len(starts)*2)
+	for _, start := range starts {
+		end := m[start]
+		last := len(boundaries) - 1
+		if last > 0 && start <= boundaries[last] {
+			if end > boundaries[last] {
+				boundaries[last] = end
+			}
+			continue
+		}
+		boundaries = append(boundaries, start, end)
+	}
+	return boundaries
+}
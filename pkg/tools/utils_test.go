@@ -25,6 +25,20 @@ func TestGenerateUniqueFilename(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, result)
 	}
 
+	// an unfinished download keeps its name
+	status := filepath.Join(".", "testfile.xz3")
+	if err = os.WriteFile(status, nil, 0644); err != nil {
+		t.Fatalf("Failed to create status file: %v", err)
+	}
+	defer os.Remove(status)
+	result, err = GenerateUniqueFilename(original, ".xz3")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if result != original {
+		t.Errorf("Expected %s, got %s", original, result)
+	}
+
 	// Test case 2: Test with a non-existing file
 	original = "nonexistingfile.txt"
 	expected = "nonexistingfile.txt"
@@ -57,3 +71,43 @@ func Test_FindPositions(t *testing.T) {
 	t.Log(len(uncovered))
 
 }
+
+func Test_MergeRanges(t *testing.T) {
+	m := map[int64]int64{
+		0:   10,
+		5:   20,
+		20:  30,
+		50:  60,
+		55:  58,
+		100: 100,
+	}
+	got := MergeRanges(m)
+	want := []int64{0, 30, 50, 60}
+	if len(got) != len(want) {
+		t.Fatal(got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatal(got)
+		}
+	}
+	uncovered := FindUncoveredPositions(100, got, 15)
+	x := int64(0)
+	for k, v := range uncovered {
+		x += v - k
+	}
+	if x != 100-40 {
+		t.Fatal("wrong", uncovered)
+	}
+}
+
+func TestGenerateUniqueFilenameStatError(t *testing.T) {
+	// a regular file as the dir can't be statted through, it isn't a free name
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := GenerateUniqueFilename(filepath.Join(file, "a.ts")); err == nil {
+		t.Errorf("want error, got %s", name)
+	}
+}